@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogger writes one line per request in JSON or combined log format.
+type accessLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	format  string
+	proxies proxyList
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	RemoteIP  string    `json:"remote_ip"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// newAccessLogger creates an access logger writing to w in the given
+// format, either "json" or "combined". The trusted list holds the CIDRs
+// or IPs of proxies whose X-Forwarded-For header should be believed.
+func newAccessLogger(w io.Writer, format, trusted string) (*accessLogger, error) {
+	if format != "json" && format != "combined" {
+		return nil, fmt.Errorf("%s is not a valid access log format, try `json` or `combined`", format)
+	}
+
+	proxies, err := parseTrustedProxies(trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{w: w, format: format, proxies: proxies}, nil
+}
+
+// proxyList holds the networks of the proxies trusted to set
+// X-Forwarded-For.
+type proxyList []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of CIDRs or IPs.
+func parseTrustedProxies(s string) (proxyList, error) {
+	var nets proxyList
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing trusted proxy %q failed: %v", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (l proxyList) trusted(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the client address for the request. If the peer is a
+// trusted proxy, X-Forwarded-For is walked from the right and the first
+// address that is not a trusted proxy is returned.
+func (l proxyList) remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			break
+		}
+		host = hop
+		if !l.trusted(hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// handler wraps h so that every request is written to the access log.
+func (l *accessLogger) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		l.log(accessLogEntry{
+			Time:      start,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Proto:     r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Duration:  time.Since(start).Seconds(),
+			RemoteIP:  l.proxies.remoteIP(r),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	})
+}
+
+func (l *accessLogger) log(e accessLogEntry) {
+	var line []byte
+	if l.format == "json" {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(b, '\n')
+	} else {
+		bytes := "-"
+		if e.Bytes > 0 {
+			bytes = fmt.Sprintf("%d", e.Bytes)
+		}
+		referer, userAgent := e.Referer, e.UserAgent
+		if referer == "" {
+			referer = "-"
+		}
+		if userAgent == "" {
+			userAgent = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %s %q %q\n",
+			e.RemoteIP,
+			e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			e.Method+" "+e.Path+" "+e.Proto,
+			e.Status,
+			bytes,
+			referer,
+			userAgent,
+		))
+	}
+
+	l.mu.Lock()
+	l.w.Write(line)
+	l.mu.Unlock()
+}
+
+// rotatingFile is an io.Writer that appends to a file and rotates it once
+// it grows past maxSize bytes, keeping at most maxBackups old files.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file with a timestamp suffix, removes the
+// oldest backups and opens a fresh file.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	backup := r.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+
+	backups, err := filepath.Glob(r.path + ".*")
+	if err == nil && r.maxBackups > 0 && len(backups) > r.maxBackups {
+		sort.Strings(backups)
+		for _, b := range backups[:len(backups)-r.maxBackups] {
+			os.Remove(b)
+		}
+	}
+
+	return r.open()
+}
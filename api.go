@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uploadACLs are the canned ACLs that can be set on objects uploaded to s3.
+var uploadACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// publicACLs are the canned ACLs that let others than the bucket's owner
+// read an object.
+var publicACLs = map[string]bool{
+	"public-read":        true,
+	"public-read-write":  true,
+	"authenticated-read": true,
+}
+
+// currentUploadACL returns the ACL for uploaded objects.
+func currentUploadACL() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return uploadACL
+}
+
+// currentPublishACL returns the ACL for published index pages and assets.
+func currentPublishACL() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return publishACL
+}
+
+// errTooLarge is returned when an upload is larger than max-upload-size.
+var errTooLarge = errors.New("upload is larger than the maximum upload size")
+
+// limitReader returns errTooLarge once more than max bytes have been read
+// from r. A max of 0 means no limit.
+type limitReader struct {
+	r        io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func newLimitReader(r io.Reader) *limitReader {
+	return &limitReader{r: r, max: maxUploadBytes()}
+}
+
+// maxUploadBytes returns the maximum upload size in bytes, 0 for no limit.
+func maxUploadBytes() int64 {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return int64(maxUploadSize) << 20
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.max > 0 && l.read > l.max {
+		l.exceeded = true
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+// apiObject is an object as returned by the API.
+type apiObject struct {
+	Mount       string   `json:"mount"`
+	Name        string   `json:"name"`
+	Size        int64    `json:"size"`
+	ContentType string   `json:"contentType,omitempty"`
+	URL         string   `json:"url"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+// apiError writes an error response as JSON.
+func apiError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// apiMount returns the mount an API request is for: the mount with the
+// given name, or else the mount served for the request's host, or else the
+// only mount.
+func apiMount(r *http.Request, name string) (*mount, error) {
+	mountsMu.RLock()
+	defer mountsMu.RUnlock()
+
+	if name != "" {
+		for _, m := range mounts {
+			if m.name == name {
+				return m, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown mount %q", name)
+	}
+
+	host := requestHost(r)
+	for _, m := range mounts {
+		for _, h := range m.hosts {
+			if h == host {
+				return m, nil
+			}
+		}
+	}
+	if len(mounts) == 1 {
+		return mounts[0], nil
+	}
+	return nil, errors.New("more than one mount is configured, set the mount parameter")
+}
+
+// objectKey checks that key is a valid object key inside the mount.
+func (m *mount) objectKey(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		return "", errors.New("object key is empty")
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	if !strings.HasPrefix(key, m.keyPrefix()) {
+		return "", fmt.Errorf("object key %q is outside of mount %s", key, m.name)
+	}
+	return key, nil
+}
+
+// keyPrefix returns the mount's bucket prefix ending in a slash, or "" if
+// the mount is the whole bucket.
+func (m *mount) keyPrefix() string {
+	prefix := strings.Trim(m.p.Prefix(), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// uploadContentType returns the content type an uploaded object is stored
+// with. It comes from the extension rather than the client, so that an
+// upload cannot make itself a page.
+func uploadContentType(key string) string {
+	return contentTypeFor(key, "")
+}
+
+// contentTypeFor returns the given content type, or else the one for the
+// extension of name.
+func contentTypeFor(name, contentType string) string {
+	if contentType != "" {
+		return contentType
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// requestScheme returns the scheme the request was made with, as far as
+// a proxy in front says so.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// siteURL returns the scheme and host that absolute links on the pages of
+// the mount start with: the public URL if one is set, or else the request's
+// if its Host is one of the mount's hosts or the listen address. Any other
+// Host header could have been sent by anyone, so "" is returned and links
+// stay relative to the server.
+func (m *mount) siteURL(r *http.Request) string {
+	configMu.RLock()
+	public, listen := publicURL, strings.ToLower(address)
+	configMu.RUnlock()
+	if public != "" {
+		return strings.TrimSuffix(public, "/")
+	}
+
+	host := requestHost(r)
+	known := host != "" && host == listen
+	for _, h := range m.hosts {
+		if h == host {
+			known = true
+		}
+	}
+	if !known {
+		return ""
+	}
+	return requestScheme(r) + "://" + r.Host
+}
+
+// objectURL returns the link to an object of the mount, through the object
+// handler if the mount's objects are proxied.
+func (m *mount) objectURL(r *http.Request, o object) string {
+	if m.proxied(currentAuthzRules()) {
+		return m.siteURL(r) + "/-/objects/" + m.name + "/" + escapeKeyPath(o.Name)
+	}
+	return "//" + o.BaseURL + "/" + escapeKeyPath(o.Name)
+}
+
+// upload writes an object to the mount's bucket and adds it to the index.
+func (m *mount) upload(ctx context.Context, key string, body io.Reader, size int64, contentType string) (object, error) {
+	o, err := m.p.Put(ctx, key, body, size, contentType)
+	if err != nil {
+		return object{}, err
+	}
+	if err := m.updateIndex(ctx, nil, o); err != nil {
+		logrus.Warnf("adding %s to the index for mount %s failed: %v", key, m.name, err)
+	}
+	return o, nil
+}
+
+// sameOrigin returns false if the request comes from a page on another
+// site, so that forms cannot be submitted cross site.
+func sameOrigin(r *http.Request) bool {
+	o := r.Header.Get("Origin")
+	if o == "" {
+		return true
+	}
+	u, err := url.Parse(o)
+	return err == nil && u.Host == r.Host
+}
+
+// objectsAPIHandler handles requests to /api/v1/objects/<key>.
+func objectsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		putObjectHandler(w, r)
+	case http.MethodPost:
+		uploadFormHandler(w, r)
+	case http.MethodDelete:
+		deleteObjectHandler(w, r)
+	default:
+		w.Header().Set("Allow", "PUT, POST, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// putObjectHandler streams the request body into the bucket as the object
+// named by the path.
+func putObjectHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := apiMount(r, r.URL.Query().Get("mount"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	key, err := m.objectKey(strings.TrimPrefix(r.URL.Path, "/api/v1/objects/"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id := identityFrom(r.Context())
+	if !authzCanWrite(currentAuthzRules(), id, m.name, key) {
+		apiError(w, http.StatusForbidden, fmt.Errorf("not allowed to write %s", key))
+		return
+	}
+
+	body := newLimitReader(r.Body)
+	if body.max > 0 && r.ContentLength > body.max {
+		apiError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+		return
+	}
+
+	o, err := m.upload(r.Context(), key, body, r.ContentLength, uploadContentType(key))
+	if body.exceeded {
+		err = errTooLarge
+	}
+	audit(r, "upload", m, key, "", err)
+	if body.exceeded {
+		apiError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+		return
+	}
+	if err != nil {
+		logrus.Warnf("uploading %s to mount %s failed: %v", key, m.name, err)
+		apiError(w, http.StatusBadGateway, fmt.Errorf("uploading %s failed", key))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiObject{
+		Mount:       m.name,
+		Name:        o.Name,
+		Size:        o.Size,
+		ContentType: o.ContentType,
+		URL:         m.objectURL(r, o),
+	})
+}
+
+// uploadFormHandler uploads the files of a multipart form, as sent by the
+// upload form on the index, then sends the browser back to the index. The
+// mount and prefix fields must come before the files.
+func uploadFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		apiError(w, http.StatusForbidden, errors.New("cross origin requests are not allowed"))
+		return
+	}
+
+	body := newLimitReader(r.Body)
+	if body.max > 0 && r.ContentLength > body.max {
+		apiError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+		return
+	}
+	r.Body = ioutil.NopCloser(body)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id := identityFrom(r.Context())
+	var (
+		m            *mount
+		name, prefix string
+		uploaded     []object
+	)
+	// add the uploads to the index once, even if a later file fails
+	defer func() {
+		if len(uploaded) == 0 {
+			return
+		}
+		if err := m.updateIndex(r.Context(), nil, uploaded...); err != nil {
+			logrus.Warnf("adding %d uploads to the index for mount %s failed: %v", len(uploaded), m.name, err)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if body.exceeded {
+			apiError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+			return
+		}
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		switch part.FormName() {
+		case "mount", "prefix":
+			v, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			if part.FormName() == "mount" {
+				name = string(v)
+			} else {
+				prefix = string(v)
+			}
+		case "file":
+			if part.FileName() == "" {
+				continue
+			}
+			if m == nil {
+				if m, err = apiMount(r, name); err != nil {
+					apiError(w, http.StatusNotFound, err)
+					return
+				}
+			}
+			key, err := m.objectKey(prefix + path.Base(part.FileName()))
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			if !authzCanWrite(currentAuthzRules(), id, m.name, key) {
+				apiError(w, http.StatusForbidden, fmt.Errorf("not allowed to write %s", key))
+				return
+			}
+
+			o, err := m.p.Put(r.Context(), key, part, -1, uploadContentType(key))
+			if body.exceeded {
+				err = errTooLarge
+			}
+			audit(r, "upload", m, key, "", err)
+			if body.exceeded {
+				apiError(w, http.StatusRequestEntityTooLarge, errTooLarge)
+				return
+			}
+			if err != nil {
+				logrus.Warnf("uploading %s to mount %s failed: %v", key, m.name, err)
+				apiError(w, http.StatusBadGateway, fmt.Errorf("uploading %s failed", key))
+				return
+			}
+			uploaded = append(uploaded, o)
+		}
+	}
+
+	if m == nil {
+		apiError(w, http.StatusBadRequest, errors.New("no files were uploaded"))
+		return
+	}
+	http.Redirect(w, r, m.path, http.StatusSeeOther)
+}
+
+// apiRequest is the body of the delete, copy and move endpoints, sent
+// either as JSON or as a form.
+type apiRequest struct {
+	Mount       string   `json:"mount"`
+	Keys        []string `json:"keys"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+}
+
+// decodeAPIRequest reads an apiRequest from the body of r. It returns true
+// if the request was a form, which should be answered with a redirect.
+func decodeAPIRequest(r *http.Request) (apiRequest, bool, error) {
+	var req apiRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			return req, false, fmt.Errorf("decoding request failed: %v", err)
+		}
+		return req, false, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return req, true, err
+	}
+	req.Mount = r.PostForm.Get("mount")
+	req.Keys = r.PostForm["key"]
+	req.Source = r.PostForm.Get("source")
+	req.Destination = r.PostForm.Get("destination")
+	return req, true, nil
+}
+
+// deleteObjects deletes keys from the mount's bucket and the index, and
+// writes an audit entry for each.
+func (m *mount) deleteObjects(r *http.Request, keys []string) error {
+	err := m.p.Delete(r.Context(), keys...)
+	for _, k := range keys {
+		audit(r, "delete", m, k, "", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.updateIndex(r.Context(), keys); err != nil {
+		logrus.Warnf("removing objects from the index for mount %s failed: %v", m.name, err)
+	}
+	return nil
+}
+
+// deleteObjectHandler deletes the object named by the path.
+func deleteObjectHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := apiMount(r, r.URL.Query().Get("mount"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	key, err := m.objectKey(strings.TrimPrefix(r.URL.Path, "/api/v1/objects/"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !authzCanWrite(currentAuthzRules(), identityFrom(r.Context()), m.name, key) {
+		apiError(w, http.StatusForbidden, fmt.Errorf("not allowed to delete %s", key))
+		return
+	}
+
+	if err := m.deleteObjects(r, []string{key}); err != nil {
+		logrus.Warnf("deleting %s from mount %s failed: %v", key, m.name, err)
+		apiError(w, http.StatusBadGateway, fmt.Errorf("deleting %s failed", key))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteHandler deletes a list of objects, using a bulk delete where the
+// provider supports it.
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		apiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if !sameOrigin(r) {
+		apiError(w, http.StatusForbidden, errors.New("cross origin requests are not allowed"))
+		return
+	}
+
+	req, form, err := decodeAPIRequest(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	m, err := apiMount(r, req.Mount)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	if len(req.Keys) == 0 {
+		apiError(w, http.StatusBadRequest, errors.New("no keys to delete"))
+		return
+	}
+
+	rules := currentAuthzRules()
+	id := identityFrom(r.Context())
+	keys := make([]string, len(req.Keys))
+	for i, k := range req.Keys {
+		if keys[i], err = m.objectKey(k); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !authzCanWrite(rules, id, m.name, keys[i]) {
+			apiError(w, http.StatusForbidden, fmt.Errorf("not allowed to delete %s", keys[i]))
+			return
+		}
+	}
+
+	if err := m.deleteObjects(r, keys); err != nil {
+		logrus.Warnf("deleting %d objects from mount %s failed: %v", len(keys), m.name, err)
+		apiError(w, http.StatusBadGateway, errors.New("deleting objects failed"))
+		return
+	}
+
+	if form {
+		http.Redirect(w, r, m.path, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"mount": m.name, "deleted": keys})
+}
+
+// copyHandler copies an object within a mount, or moves it if move is set.
+func copyHandler(move bool) http.HandlerFunc {
+	action := "copy"
+	if move {
+		action = "move"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			apiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if !sameOrigin(r) {
+			apiError(w, http.StatusForbidden, errors.New("cross origin requests are not allowed"))
+			return
+		}
+
+		req, form, err := decodeAPIRequest(r)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		m, err := apiMount(r, req.Mount)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		src, err := m.objectKey(req.Source)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		dst, err := m.objectKey(req.Destination)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		if src == dst {
+			apiError(w, http.StatusBadRequest, errors.New("source and destination are the same"))
+			return
+		}
+
+		rules := currentAuthzRules()
+		id := identityFrom(r.Context())
+		canRead := authzAllowed(rules, id, m.name, src)
+		if move {
+			canRead = authzCanWrite(rules, id, m.name, src)
+		}
+		if !canRead || !authzCanWrite(rules, id, m.name, dst) {
+			apiError(w, http.StatusForbidden, fmt.Errorf("not allowed to %s %s to %s", action, src, dst))
+			return
+		}
+
+		var o object
+		if move {
+			o, err = m.p.Move(r.Context(), src, dst)
+		} else {
+			o, err = m.p.Copy(r.Context(), src, dst)
+		}
+		audit(r, action, m, src, dst, err)
+		if err != nil {
+			logrus.Warnf("%s of %s to %s in mount %s failed: %v", action, src, dst, m.name, err)
+			apiError(w, http.StatusBadGateway, fmt.Errorf("%s of %s failed", action, src))
+			return
+		}
+
+		var remove []string
+		if move {
+			remove = []string{src}
+		}
+		if err := m.updateIndex(r.Context(), remove, o); err != nil {
+			logrus.Warnf("updating the index for mount %s failed: %v", m.name, err)
+		}
+
+		if form {
+			http.Redirect(w, r, m.path, http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(apiObject{
+			Mount:       m.name,
+			Name:        o.Name,
+			Size:        o.Size,
+			ContentType: o.ContentType,
+			URL:         m.objectURL(r, o),
+		})
+	}
+}
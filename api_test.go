@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestObjectKey(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		key    string
+		want   string
+		ok     bool
+	}{
+		{"/", "dance.gif", "dance.gif", true},
+		{"/", "/reactions/dance.gif", "reactions/dance.gif", true},
+		{"/", "", "", false},
+		{"/", "a//b", "", false},
+		{"/", "a/../b", "", false},
+		{"/", "./a", "", false},
+		{"gifs", "gifs/dance.gif", "gifs/dance.gif", true},
+		{"gifs/", "gifs/dance.gif", "gifs/dance.gif", true},
+		{"gifs", "gifs-private/dance.gif", "", false},
+		{"gifs/", "gifs-private/dance.gif", "", false},
+		{"gifs", "gifs", "", false},
+		{"gifs", "other/dance.gif", "", false},
+		{"gifs/reactions", "gifs/reactions/dance.gif", "gifs/reactions/dance.gif", true},
+		{"gifs/reactions", "gifs/reactionsx/dance.gif", "", false},
+	} {
+		m := &mount{name: "gifs", p: newFakeCloud(c.prefix, nil)}
+		got, err := m.objectKey(c.key)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("prefix %q, key %q: got %q, %v, want %q, ok %t", c.prefix, c.key, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	for key, want := range map[string]string{
+		"dance.gif":  "image/gif",
+		"page.html":  "text/html; charset=utf-8",
+		"logo.svg":   "image/svg+xml",
+		"no-ext":     "application/octet-stream",
+		"notes.TXT":  "text/plain; charset=utf-8",
+		"report.pdf": "application/pdf",
+	} {
+		if got := uploadContentType(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	public := newFakeCloud("/", nil)
+	local := newFakeCloud("/", nil)
+	local.baseURL = ""
+	o := object{Name: "new dance#1?100%.gif", BaseURL: public.baseURL}
+
+	for _, c := range []struct {
+		p    cloud
+		host string
+		want string
+	}{
+		{public, "evil.example.com", "//bucket.example.com/new%20dance%231%3F100%25.gif"},
+		{local, "evil.example.com", "/-/objects/gifs/new%20dance%231%3F100%25.gif"},
+		{local, "gifs.example.com", "http://gifs.example.com/-/objects/gifs/new%20dance%231%3F100%25.gif"},
+	} {
+		m := &mount{name: "gifs", hosts: []string{"gifs.example.com"}, p: c.p}
+		r := httptest.NewRequest("GET", "/api/v1/search", nil)
+		r.Host = c.host
+		if got := m.objectURL(r, o); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.host, got, c.want)
+		}
+	}
+}
+
+func TestDeleteCopyMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newFakeCloud("/", map[string]string{
+		"builds/logo.png":     "PNG",
+		"public/dance.gif":    "GIF89a",
+		"public/wave.gif":     "GIF87a",
+		"public/shrug.gif":    "GIF89a",
+		"public/facepalm.gif": "GIF89a",
+	})
+	m := &mount{name: "gifs", path: "/", p: p, template: "templates/layout.html", index: filepath.Join(dir, "index.html"), rendered: map[string][]byte{}}
+	for _, k := range []string{"builds/logo.png", "public/dance.gif", "public/facepalm.gif", "public/shrug.gif", "public/wave.gif"} {
+		m.files = append(m.files, p.object(k))
+	}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	configMu.Lock()
+	authzRules = []authzRule{
+		{Prefix: "builds/", Everyone: true},
+		{Prefix: "public/", Everyone: true},
+		{Prefix: "public/", Groups: []string{"eng"}, Write: true},
+	}
+	configMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		configMu.Lock()
+		authzRules = nil
+		configMu.Unlock()
+	}()
+
+	eng := &identity{User: "alice", Groups: []string{"eng"}}
+	exists := func(key string) bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		_, ok := p.objects[key]
+		return ok
+	}
+	listed := func(key string) bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		for _, f := range m.files {
+			if f.Name == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, c := range []struct {
+		name    string
+		h       http.HandlerFunc
+		method  string
+		body    string
+		form    bool
+		origin  string
+		id      *identity
+		want    int
+		gone    []string
+		created []string
+	}{
+		{"delete with GET", deleteHandler, "GET", "", false, "", eng, http.StatusMethodNotAllowed, nil, nil},
+		{"delete cross origin", deleteHandler, "POST", `{"keys":["public/dance.gif"]}`, false, "http://evil.example.com", eng, http.StatusForbidden, nil, nil},
+		{"delete anonymously", deleteHandler, "POST", `{"keys":["public/dance.gif"]}`, false, "", nil, http.StatusForbidden, nil, nil},
+		{"delete without write access", deleteHandler, "POST", `{"keys":["public/dance.gif","builds/logo.png"]}`, false, "", eng, http.StatusForbidden, nil, nil},
+		{"delete no keys", deleteHandler, "POST", `{"keys":[]}`, false, "", eng, http.StatusBadRequest, nil, nil},
+		{"delete", deleteHandler, "POST", `{"keys":["public/dance.gif"]}`, false, "http://example.com", eng, http.StatusOK, []string{"public/dance.gif"}, nil},
+		{"delete form", deleteHandler, "POST", "key=public/wave.gif", true, "", eng, http.StatusSeeOther, []string{"public/wave.gif"}, nil},
+		{"copy to itself", copyHandler(false), "POST", `{"source":"public/shrug.gif","destination":"public/shrug.gif"}`, false, "", eng, http.StatusBadRequest, nil, nil},
+		{"copy outside the mount", copyHandler(false), "POST", `{"source":"public/shrug.gif","destination":"../shrug.gif"}`, false, "", eng, http.StatusBadRequest, nil, nil},
+		{"copy to a read only prefix", copyHandler(false), "POST", `{"source":"public/shrug.gif","destination":"builds/shrug.gif"}`, false, "", eng, http.StatusForbidden, nil, nil},
+		{"copy from a read only prefix", copyHandler(false), "POST", `{"source":"builds/logo.png","destination":"public/logo.png"}`, false, "", eng, http.StatusOK, nil, []string{"builds/logo.png", "public/logo.png"}},
+		{"move from a read only prefix", copyHandler(true), "POST", `{"source":"builds/logo.png","destination":"public/logo2.png"}`, false, "", eng, http.StatusForbidden, nil, nil},
+		{"move", copyHandler(true), "POST", `{"source":"public/shrug.gif","destination":"public/reactions/shrug.gif"}`, false, "", eng, http.StatusOK, []string{"public/shrug.gif"}, []string{"public/reactions/shrug.gif"}},
+		{"move form", copyHandler(true), "POST", "source=public/facepalm.gif&destination=public/old/facepalm.gif", true, "", eng, http.StatusSeeOther, []string{"public/facepalm.gif"}, []string{"public/old/facepalm.gif"}},
+	} {
+		r := httptest.NewRequest(c.method, "http://example.com/api/v1/delete", strings.NewReader(c.body))
+		r.Header.Set("Content-Type", "application/json")
+		if c.form {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.id != nil {
+			r = r.WithContext(withIdentity(r.Context(), c.id))
+		}
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: got status %d, want %d: %s", c.name, w.Code, c.want, w.Body)
+			continue
+		}
+		for _, k := range c.gone {
+			if exists(k) || listed(k) {
+				t.Errorf("%s: %s is still there, in the bucket %t, in the index %t", c.name, k, exists(k), listed(k))
+			}
+		}
+		for _, k := range c.created {
+			if !exists(k) || !listed(k) {
+				t.Errorf("%s: %s is missing, in the bucket %t, in the index %t", c.name, k, exists(k), listed(k))
+			}
+		}
+	}
+
+	// the refused delete and move left the read only object alone
+	if !exists("builds/logo.png") || !listed("builds/logo.png") {
+		t.Errorf("builds/logo.png was removed by a refused request")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveFormats maps the extensions that can be requested to the content
+// type of the archive.
+var archiveFormats = map[string]string{
+	".zip":    "application/zip",
+	".tar.gz": "application/gzip",
+}
+
+// maxArchiveBytes returns the maximum total size of the objects in an
+// archive in bytes, 0 for no limit.
+func maxArchiveBytes() int64 {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return int64(maxArchiveSize) << 20
+}
+
+// archiveHandler streams the objects under a prefix as a zip or tar.gz
+// archive. Requests look like /archive/<prefix>.zip, where the prefix
+// includes the mount's bucket prefix, and /archive/.zip is the whole mount.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/archive/")
+	var ext string
+	for e := range archiveFormats {
+		if strings.HasSuffix(name, e) {
+			ext = e
+			break
+		}
+	}
+	if ext == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m, err := apiMount(r, r.URL.Query().Get("mount"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prefix := strings.Trim(strings.TrimSuffix(name, ext), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	if prefix == "" {
+		prefix = m.keyPrefix()
+	}
+	if prefix != m.keyPrefix() {
+		if _, err := m.objectKey(strings.TrimSuffix(prefix, "/")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	files, err := m.p.List(r.Context(), prefix, "", "", 1000, &storage.Query{Prefix: prefix})
+	if err != nil {
+		logrus.Warnf("listing %s in mount %s for an archive failed: %v", prefix, m.name, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	// keep the objects the viewer can read, without the keys the index
+	// leaves out
+	files = m.withoutPublished(files)
+	configMu.RLock()
+	describe := describeObjects
+	configMu.RUnlock()
+	if describe {
+		files = withoutDescriptions(files)
+	}
+	rules := currentAuthzRules()
+	id := identityFrom(r.Context())
+	var total int64
+	n := 0
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, "/") || !authzAllowed(rules, id, m.name, f.Name) {
+			continue
+		}
+		files[n] = f
+		n++
+		total += f.Size
+	}
+	files = files[:n]
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if max := maxArchiveBytes(); max > 0 && total > max {
+		http.Error(w, fmt.Sprintf("archive would be %d bytes, the limit is %d", total, max), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	filename := path.Base(strings.TrimSuffix(prefix, "/"))
+	if filename == "." || filename == "/" {
+		filename = m.name
+	}
+	w.Header().Set("Content-Type", archiveFormats[ext])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+ext))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// names in the archive are relative to the parent of the prefix, so
+	// the archive unpacks into a folder named after it
+	base := strings.TrimSuffix(prefix, filename+"/")
+	if ext == ".zip" {
+		err = writeZip(r, w, m, files, base)
+	} else {
+		err = writeTarGz(r, w, m, files, base)
+	}
+	if err != nil {
+		// the response has started, so the best we can do is leave the
+		// archive incomplete for the client to notice
+		logrus.Warnf("streaming archive of %s in mount %s failed: %v", prefix, m.name, err)
+		return
+	}
+	logrus.Debugf("streamed archive of %d objects under %s in mount %s", len(files), prefix, m.name)
+}
+
+// writeZip streams the objects into a zip archive written to w.
+func writeZip(r *http.Request, w io.Writer, m *mount, files []object, base string) error {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     strings.TrimPrefix(f.Name, base),
+			Method:   zip.Deflate,
+			Modified: f.Modified,
+		})
+		if err != nil {
+			return err
+		}
+		if err := copyObject(r, fw, m, f.Name); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz streams the objects into a gzipped tar archive written to w.
+func writeTarGz(r *http.Request, w io.Writer, m *mount, files []object, base string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    strings.TrimPrefix(f.Name, base),
+			Mode:    0644,
+			Size:    f.Size,
+			ModTime: f.Modified,
+		}); err != nil {
+			return err
+		}
+		if err := copyObject(r, tw, m, f.Name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyObject streams the object with the key into w.
+func copyObject(r *http.Request, w io.Writer, m *mount, key string) error {
+	body, _, err := m.p.Open(r.Context(), key)
+	if err != nil {
+		return fmt.Errorf("opening object %s failed: %v", key, err)
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("copying object %s failed: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestArchiveHandler(t *testing.T) {
+	p := newFakeCloud("gifs/", map[string]string{
+		"gifs/reactions/dance.gif":      "dance",
+		"gifs/reactions/dance.gif.json": `{"title": "Dance"}`,
+		"gifs/reactions/index.html":     "published index",
+		"gifs/reactions/_manifest.json": "{}",
+		"gifs/reactions/wave.gif":       "wave",
+		"gifs-private/secret.gif":       "secret",
+	})
+	p.pageSize = 2
+	m := &mount{name: "gifs", path: "/", p: p, published: map[string]bool{"gifs/reactions/index.html": true}}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	describeObjects = true
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		describeObjects = false
+	}()
+
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", "/archive/gifs/reactions.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if want := time.Unix(1500000000, 0); !f.Modified.Equal(want) {
+			t.Errorf("%s: got modified %s, want %s", f.Name, f.Modified, want)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "reactions/dance.gif" || names[1] != "reactions/wave.gif" {
+		t.Errorf("got entries %v, want [reactions/dance.gif reactions/wave.gif]", names)
+	}
+	if p.pages < 2 {
+		t.Errorf("listed %d pages, want more than one", p.pages)
+	}
+
+	// keys next to the mount's prefix are outside of it
+	w = httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", "/archive/gifs-private.zip", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("archive outside of the mount: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
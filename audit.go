@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditEntry records a change made to a bucket through the API.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	RemoteIP    string    `json:"remote_ip"`
+	Action      string    `json:"action"`
+	Mount       string    `json:"mount"`
+	Key         string    `json:"key"`
+	Destination string    `json:"destination,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLogger writes one JSON line per change.
+type auditLogger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	proxies proxyList
+}
+
+// auditLog is set at startup when an audit log is configured. Without one,
+// audit entries go to the server log.
+var auditLog *auditLogger
+
+// newAuditLogger creates an audit logger writing to w. The trusted list is
+// used to find the client address, as for the access log.
+func newAuditLogger(w io.Writer, trusted string) (*auditLogger, error) {
+	proxies, err := parseTrustedProxies(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{w: w, proxies: proxies}, nil
+}
+
+func (l *auditLogger) log(e auditEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	l.w.Write(append(b, '\n'))
+	l.mu.Unlock()
+}
+
+// audit records a change to key, and dst for copies and moves, made by the
+// request.
+func audit(r *http.Request, action string, m *mount, key, dst string, err error) {
+	e := auditEntry{
+		Time:        time.Now(),
+		Action:      action,
+		Mount:       m.name,
+		Key:         key,
+		Destination: dst,
+		Outcome:     "success",
+	}
+	if id := identityFrom(r.Context()); id != nil {
+		e.User = id.User
+	}
+	if err != nil {
+		e.Outcome = "failure"
+		e.Error = err.Error()
+	}
+
+	if auditLog != nil {
+		e.RemoteIP = auditLog.proxies.remoteIP(r)
+		auditLog.log(e)
+		return
+	}
+
+	e.RemoteIP = proxyList(nil).remoteIP(r)
+	logrus.WithFields(logrus.Fields{
+		"user":        e.User,
+		"remote_ip":   e.RemoteIP,
+		"action":      e.Action,
+		"mount":       e.Mount,
+		"key":         e.Key,
+		"destination": e.Destination,
+		"outcome":     e.Outcome,
+		"error":       e.Error,
+	}).Info("audit")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authConfig is the auth section of the config file.
+type authConfig struct {
+	Htpasswd   string              `yaml:"htpasswd"`
+	Tokens     []tokenConfig       `yaml:"tokens"`
+	AccessKeys []accessKeyConfig   `yaml:"access_keys"`
+	OIDC       *oidcConfig         `yaml:"oidc"`
+	Groups     map[string][]string `yaml:"groups"`
+	Session    struct {
+		Key string        `yaml:"key"`
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"session"`
+}
+
+// tokenConfig is a static bearer token and the identity it grants.
+type tokenConfig struct {
+	Token  string   `yaml:"token"`
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups"`
+}
+
+// identity is an authenticated user.
+type identity struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// errNoCredentials is returned by an authenticator when the request does
+// not carry credentials for it.
+var errNoCredentials = errors.New("no credentials")
+
+// authenticator is an authentication backend.
+type authenticator interface {
+	// authenticate returns the identity for the request, errNoCredentials
+	// if the request has no credentials for this backend, or another error
+	// if the credentials are invalid.
+	authenticate(r *http.Request) (*identity, error)
+}
+
+// authState holds the authentication backends built from the config.
+type authState struct {
+	backends []authenticator
+	groups   map[string][]string
+	basic    bool
+	oidc     *oidcAuth
+}
+
+// auth holds the authentication backends for the last applied config. A nil
+// auth means authentication is disabled.
+var auth *authState
+
+// newAuthState builds the authentication backends from the config. It
+// returns nil if no backend is configured.
+func newAuthState(c authConfig) (*authState, error) {
+	a := &authState{groups: c.Groups}
+
+	if c.Htpasswd != "" {
+		h, err := loadHtpasswd(c.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		a.backends = append(a.backends, h)
+		a.basic = true
+	}
+
+	if len(c.Tokens) > 0 {
+		t := tokenAuth{}
+		for i, tc := range c.Tokens {
+			if tc.Token == "" || tc.User == "" {
+				return nil, fmt.Errorf("auth token %d needs a token and a user", i)
+			}
+			t[tc.Token] = &identity{User: tc.User, Groups: tc.Groups}
+		}
+		a.backends = append(a.backends, t)
+	}
+
+	if len(c.AccessKeys) > 0 {
+		s, err := newSigV4Auth(c.AccessKeys, s3GatewayPath)
+		if err != nil {
+			return nil, err
+		}
+		if s3GatewayPath == "" {
+			logrus.Warn("auth access keys are only used by the S3 gateway, which is not enabled")
+		} else {
+			a.backends = append(a.backends, s)
+		}
+	}
+
+	sessionKey := c.Session.Key
+	if v, ok := os.LookupEnv(envName("auth.session.key")); ok {
+		sessionKey = v
+	}
+	sessionTTL := c.Session.TTL
+	if sessionTTL == 0 {
+		sessionTTL = 24 * time.Hour
+	}
+	sessions, err := newSessionStore(sessionKey, sessionTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.OIDC != nil {
+		o, err := newOIDCAuth(*c.OIDC, sessions)
+		if err != nil {
+			return nil, err
+		}
+		a.backends = append(a.backends, o)
+		a.oidc = o
+	}
+
+	if len(a.backends) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// authenticate runs the request through every backend and returns the
+// first identity found, with the configured groups added.
+func (a *authState) authenticate(r *http.Request) (*identity, error) {
+	for _, b := range a.backends {
+		id, err := b.authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &identity{
+			User:   id.User,
+			Groups: append(append([]string{}, id.Groups...), a.groups[id.User]...),
+		}, nil
+	}
+	return nil, errNoCredentials
+}
+
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx holding the identity.
+func withIdentity(ctx context.Context, id *identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the identity stored in ctx, or nil.
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// publicPaths can be requested without authenticating.
+var publicPaths = map[string]bool{
+	"/healthz":       true,
+	"/readyz":        true,
+	"/metrics":       true,
+	"/auth/login":    true,
+	"/auth/callback": true,
+	"/auth/logout":   true,
+	"/favicon.ico":   true,
+}
+
+// authHandler requires every request but the public paths to authenticate
+// with one of the configured backends, and stores the identity in the
+// request context. Browsers are sent to the OIDC login if it is enabled.
+func authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		configMu.RLock()
+		a := auth
+		configMu.RUnlock()
+
+		if a == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if a.oidc != nil && strings.HasPrefix(r.URL.Path, "/auth/") {
+			a.oidc.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := a.authenticate(r)
+		if err != nil && err != errNoCredentials {
+			logrus.Debugf("authentication failed for %s: %v", r.URL.Path, err)
+		}
+		if id == nil && publicPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if id == nil {
+			if a.oidc != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/auth/login?rd="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			if a.basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="s3server", charset="UTF-8"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="s3server"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), id)))
+	})
+}
+
+// htpasswdAuth checks basic auth credentials against an htpasswd file.
+// Only bcrypt and {SHA} hashes are supported.
+type htpasswdAuth map[string]string
+
+func loadHtpasswd(file string) (htpasswdAuth, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("opening htpasswd file %s failed: %v", file, err)
+	}
+	defer f.Close()
+
+	h := htpasswdAuth{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("htpasswd file %s line %d: expected user:hash", file, n)
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("htpasswd file %s line %d: only bcrypt and {SHA} hashes are supported", file, n)
+		}
+		h[parts[0]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading htpasswd file %s failed: %v", file, err)
+	}
+	return h, nil
+}
+
+func (h htpasswdAuth) authenticate(r *http.Request) (*identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNoCredentials
+	}
+
+	hash, ok := h[user]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %q", user)
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		if subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) != 1 {
+			return nil, fmt.Errorf("wrong password for user %q", user)
+		}
+	} else if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)); err != nil {
+		return nil, fmt.Errorf("wrong password for user %q", user)
+	}
+
+	return &identity{User: user}, nil
+}
+
+// tokenAuth checks bearer tokens against a static list.
+type tokenAuth map[string]*identity
+
+func (t tokenAuth) authenticate(r *http.Request) (*identity, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, errNoCredentials
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+
+	for k, id := range t {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(token)) == 1 {
+			return id, nil
+		}
+	}
+	return nil, errors.New("unknown bearer token")
+}
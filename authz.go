@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// authzRule grants read access, and optionally write access, to the objects
+// under a key prefix to a set of users and groups, or to everyone.
+type authzRule struct {
+	Mount    string   `yaml:"mount"`
+	Prefix   string   `yaml:"prefix"`
+	Users    []string `yaml:"users"`
+	Groups   []string `yaml:"groups"`
+	Everyone bool     `yaml:"everyone"`
+	Write    bool     `yaml:"write"`
+}
+
+// authzRules holds the rules from the last applied config. With no rules,
+// everyone who gets past authentication may read every object. With rules,
+// an object may only be read if a rule allows it.
+var authzRules []authzRule
+
+// validateAuthzRules checks that every rule grants access to someone.
+func validateAuthzRules(rules []authzRule) error {
+	for _, r := range rules {
+		if !r.Everyone && len(r.Users) == 0 && len(r.Groups) == 0 {
+			return fmt.Errorf("authz rule for prefix %q grants access to no one", r.Prefix)
+		}
+	}
+	return nil
+}
+
+// currentAuthzRules returns the rules from the last applied config.
+func currentAuthzRules() []authzRule {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return authzRules
+}
+
+// allows returns true if the rule grants the identity access to the key.
+func (r authzRule) allows(id *identity, mountName, key string) bool {
+	if r.Mount != "" && r.Mount != mountName {
+		return false
+	}
+	if !strings.HasPrefix(key, r.Prefix) {
+		return false
+	}
+	if r.Everyone {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	for _, u := range r.Users {
+		if u == id.User {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, ig := range id.Groups {
+			if g == ig {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authzAllowed returns true if the identity may read the key of the mount.
+func authzAllowed(rules []authzRule, id *identity, mountName, key string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, r := range rules {
+		if r.allows(id, mountName, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// authzCanWrite returns true if the identity may upload or change the key
+// of the mount. Writes always need an authenticated identity, and when
+// rules are configured, a rule that allows the key and grants write.
+func authzCanWrite(rules []authzRule, id *identity, mountName, key string) bool {
+	if id == nil {
+		return false
+	}
+	if len(rules) == 0 {
+		return true
+	}
+	for _, r := range rules {
+		if r.Write && r.allows(id, mountName, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRenderedPages bounds the number of pages cached per mount.
+const maxRenderedPages = 1024
+
+// viewerKey identifies the set of objects an identity can see, so rendered
+// pages can be shared between viewers with the same user and groups.
+func viewerKey(id *identity) string {
+	if id == nil {
+		return ""
+	}
+	groups := append([]string{}, id.Groups...)
+	sort.Strings(groups)
+	return id.User + "\x00" + strings.Join(groups, "\x00")
+}
+
+// mountFor returns the mount whose index is at the path, or nil.
+func mountFor(p string) *mount {
+	mountsMu.RLock()
+	defer mountsMu.RUnlock()
+	for _, m := range mounts {
+		if p == m.path || p == m.path+"index.html" {
+			return m
+		}
+	}
+	return nil
+}
+
+// mountNamed returns the mount with the name, or nil.
+func mountNamed(name string) *mount {
+	mountsMu.RLock()
+	defer mountsMu.RUnlock()
+	for _, m := range mounts {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// proxied returns true if the mount's objects are linked through the
+// object handler: with authz rules, so that reads are checked, or if the
+// provider is not served over HTTP itself.
+func (m *mount) proxied(rules []authzRule) bool {
+	return len(rules) > 0 || m.p.BaseURL() == ""
+}
+
+// renderFor renders the index of the mount with only the objects the
+// identity may read. Objects link to the object handler, relative to the
+// server, so that they are checked again when they are fetched. Pages are
+// cached per viewer until the next listing.
+func (m *mount) renderFor(id *identity, rules []authzRule) ([]byte, error) {
+	key := viewerKey(id)
+
+	m.mu.RLock()
+	page, ok := m.rendered[key]
+	files, lastUpdated := m.files, m.lastUpdated
+	m.mu.RUnlock()
+	observeCache("pages", ok)
+	if ok {
+		return page, nil
+	}
+
+	baseURL := "/-/objects/" + m.name
+	visible := []object{}
+	for _, o := range files {
+		if authzAllowed(rules, id, m.name, o.Name) {
+			o.BaseURL = baseURL
+			visible = append(visible, o)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := m.render(&b, m.data(visible, lastUpdated, false)); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	if m.rendered != nil && len(m.rendered) < maxRenderedPages {
+		m.rendered[key] = b.Bytes()
+	}
+	m.mu.Unlock()
+	return b.Bytes(), nil
+}
+
+// indexHandler serves the index of a mount rendered for the viewer when
+// its objects are proxied. Otherwise the static index is served by h.
+func indexHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := currentAuthzRules()
+		m := mountFor(r.URL.Path)
+		if m == nil || !m.proxied(rules) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		page, err := m.renderFor(identityFrom(r.Context()), rules)
+		if err != nil {
+			logrus.Warnf("rendering index for mount %s failed: %v", m.name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Write(page)
+	})
+}
+
+// inlineTypes are the media types, by prefix, that objects are shown with
+// in the browser. Anything else, like HTML or SVG that could run script
+// with the viewer's session, is downloaded.
+var inlineTypes = []string{"image/gif", "image/png", "image/jpeg", "image/webp", "image/bmp", "image/x-icon", "video/", "audio/", "text/plain"}
+
+// setObjectHeaders sets the headers for serving an object from the same
+// origin as the pages: its content type, no sniffing, a sandbox, and an
+// attachment disposition unless it is a type that is safe to show.
+func setObjectHeaders(h http.Header, key, contentType string) {
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, t := range inlineTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return
+		}
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)}))
+}
+
+// objectHandler serves an object from a mount's bucket after checking the
+// authz rules. Requests look like /-/objects/<mount>/<key>.
+func objectHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/-/objects/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m := mountNamed(parts[0])
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := m.objectKey(parts[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !authzAllowed(currentAuthzRules(), identityFrom(r.Context()), m.name, key) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	reader, o, err := m.openObject(r.Context(), key)
+	if err != nil {
+		logrus.Debugf("opening object %s in mount %s failed: %v", key, m.name, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer reader.Close()
+
+	// media players seek with range requests
+	setObjectHeaders(w.Header(), key, contentTypeFor(key, o.ContentType))
+	w.Header().Set("Cache-Control", "private")
+	http.ServeContent(w, r, key, o.Modified, reader)
+}
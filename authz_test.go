@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestObjectHandlerHeaders(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{
+		"dance.gif":  "GIF89a",
+		"page.html":  "<script>alert(1)</script>",
+		"logo.svg":   "<svg onload=alert(1)>",
+		"notes.txt":  "hello",
+		"report.pdf": "%PDF-1.4",
+	})
+	p.types["page.html"] = "text/html"
+	p.types["logo.svg"] = "image/svg+xml"
+	p.types["dance.gif"] = "image/gif"
+	mountsMu.Lock()
+	mounts = []*mount{{name: "gifs", path: "/", p: p}}
+	mountsMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+	}()
+
+	for _, c := range []struct {
+		key         string
+		contentType string
+		attachment  bool
+	}{
+		{"dance.gif", "image/gif", false},
+		{"notes.txt", "text/plain; charset=utf-8", false},
+		{"page.html", "text/html", true},
+		{"logo.svg", "image/svg+xml", true},
+		{"report.pdf", "application/pdf", true},
+	} {
+		w := httptest.NewRecorder()
+		objectHandler(w, httptest.NewRequest("GET", "/-/objects/gifs/"+c.key, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", c.key, w.Code)
+			continue
+		}
+		h := w.Header()
+		if got := h.Get("Content-Type"); got != c.contentType {
+			t.Errorf("%s: got content type %q, want %q", c.key, got, c.contentType)
+		}
+		if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("%s: missing nosniff or sandbox: %v", c.key, h)
+		}
+		want := ""
+		if c.attachment {
+			want = `attachment; filename=` + c.key
+		}
+		if got := h.Get("Content-Disposition"); got != want {
+			t.Errorf("%s: got disposition %q, want %q", c.key, got, want)
+		}
+	}
+}
+
+func TestObjectHandlerRange(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{"dance.gif": "GIF89a"})
+	m := &mount{name: "gifs", path: "/", p: p}
+	m.files = []object{{Name: "dance.gif", Size: 6}}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+	}()
+
+	r := httptest.NewRequest("GET", "/-/objects/gifs/dance.gif", nil)
+	r.Header.Set("Range", "bytes=3-")
+	w := httptest.NewRecorder()
+	objectHandler(w, r)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "89a" {
+		t.Errorf("got status %d with %q, want %d with %q", w.Code, w.Body, http.StatusPartialContent, "89a")
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 3-5/6" {
+		t.Errorf("got content range %q", got)
+	}
+
+	// only the requested range is read from the provider
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.opened != 3 {
+		t.Errorf("opened %d bytes, want 3", p.opened)
+	}
+}
+
+func TestIndexHandlerLinks(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{"new dance.gif": "GIF89a"})
+	p.baseURL = ""
+	m := &mount{name: "gifs", path: "/", p: p, template: "templates/layout.html", rendered: map[string][]byte{}}
+	m.files = []object{{Name: "new dance.gif", Size: 6}}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+	}()
+
+	lookups := func(result string) float64 {
+		cacheLookups.mu.Lock()
+		defer cacheLookups.mu.Unlock()
+		return cacheLookups.values[cacheLookups.key([]string{"pages", result})]
+	}
+	hits, misses := lookups("hit"), lookups("miss")
+
+	h := indexHandler(http.NotFoundHandler())
+	for _, host := range []string{"gifs.example.com", "evil.example.com", "other.example.com"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", host, w.Code, w.Body)
+		}
+		page := w.Body.String()
+		if !strings.Contains(page, `href="/-/objects/gifs/new%20dance.gif"`) || strings.Contains(page, host) {
+			t.Errorf("%s: objects are not linked relative to the server:\n%s", host, page)
+		}
+	}
+
+	// the Host is not part of the cache key
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.rendered) != 1 {
+		t.Errorf("got %d cached pages, want 1", len(m.rendered))
+	}
+	if got := lookups("hit") - hits; got != 2 {
+		t.Errorf("counted %v page cache hits, want 2", got)
+	}
+	if got := lookups("miss") - misses; got != 1 {
+		t.Errorf("counted %v page cache misses, want 1", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// clientCertRule maps client certificates whose subject common name or a
+// subject alternative name matches Match to the URL path prefixes they
+// may request.
+type clientCertRule struct {
+	Match    string   `yaml:"match"`
+	Prefixes []string `yaml:"prefixes"`
+}
+
+// clientCertRules holds the rules from the last applied config. With no
+// rules, any certificate signed by the client CA may request any path.
+var clientCertRules []clientCertRule
+
+// unauthenticatedPaths can be requested without a client certificate so
+// that health checks and metrics scrapers keep working.
+var unauthenticatedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// loadClientCAs reads a PEM bundle of certificate authorities.
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle %s failed: %v", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", file)
+	}
+	return pool, nil
+}
+
+// validateClientCertRules checks that every rule has a valid pattern and
+// at least one prefix.
+func validateClientCertRules(rules []clientCertRule) error {
+	for _, r := range rules {
+		if r.Match == "" {
+			return fmt.Errorf("client cert rule has no match")
+		}
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return fmt.Errorf("client cert rule %q: %v", r.Match, err)
+		}
+		if len(r.Prefixes) == 0 {
+			return fmt.Errorf("client cert rule %q has no prefixes", r.Match)
+		}
+	}
+	return nil
+}
+
+// certNames returns the subject common name and subject alternative names
+// of a certificate.
+func certNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// clientCertAllowed returns true if the certificate may request the path.
+func clientCertAllowed(cert *x509.Certificate, p string, rules []clientCertRule) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	names := certNames(cert)
+	for _, r := range rules {
+		matched := false
+		for _, n := range names {
+			if ok, _ := path.Match(r.Match, n); ok && n != "" {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		for _, prefix := range r.Prefixes {
+			if strings.HasPrefix(p, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// clientCertHandler requires a verified client certificate for every
+// request but the health checks and metrics, and enforces the client cert rules.
+func clientCertHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+
+		configMu.RLock()
+		rules := clientCertRules
+		configMu.RUnlock()
+
+		if !clientCertAllowed(r.TLS.VerifiedChains[0][0], r.URL.Path, rules) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
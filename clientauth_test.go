@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCertHandler(t *testing.T) {
+	h := clientCertHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		path string
+		cert bool
+		want int
+	}{
+		{"/healthz", false, http.StatusOK},
+		{"/readyz", false, http.StatusOK},
+		{"/metrics", false, http.StatusOK},
+		{"/", false, http.StatusUnauthorized},
+		{"/metrics/", false, http.StatusUnauthorized},
+		{"/", true, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.cert {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s with cert %v: got status %d, want %d", c.path, c.cert, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix for environment variables that override
+// settings from the config file.
+const envPrefix = "S3SERVER_"
+
+// configKeys maps the dotted keys of the config file to the flags they set.
+// The environment variable for a key is envPrefix followed by the key in
+// upper case with dots replaced by underscores, ex. S3SERVER_S3_SECRET.
+var configKeys = map[string]string{
+	"provider":  "provider",
+	"bucket":    "bucket",
+	"interval":  "interval",
+	"templates": "templates",
+
+	"s3.key":    "s3key",
+	"s3.secret": "s3secret",
+	"s3.region": "s3region",
+
+	"listen.address": "address",
+	"listen.port":    "p",
+
+	"public_url": "public-url",
+
+	"tls.cert":     "cert",
+	"tls.key":      "key",
+	"tls.cert_dir": "cert-dir",
+
+	"tls.min_version":   "tls-min-version",
+	"tls.ciphers":       "tls-ciphers",
+	"tls.http_redirect": "http-redirect",
+	"tls.client_ca":     "client-ca",
+
+	"ready_intervals": "ready-intervals",
+
+	"tracing.otlp_endpoint": "otlp-endpoint",
+	"tracing.sample":        "trace-sample",
+
+	"access_log.path":        "access-log",
+	"access_log.format":      "access-log-format",
+	"access_log.max_size":    "access-log-max-size",
+	"access_log.max_backups": "access-log-max-backups",
+	"access_log.trusted":     "trusted-proxies",
+
+	"audit_log.path": "audit-log",
+
+	"upload.acl":      "upload-acl",
+	"upload.public":   "upload-public",
+	"upload.max_size": "max-upload-size",
+	"upload.dir":      "upload-dir",
+	"upload.expiry":   "upload-expiry",
+
+	"archive.max_size": "max-archive-size",
+
+	"webdav.path":     "webdav",
+	"webdav.writable": "webdav-writable",
+
+	"s3_gateway.path": "s3-gateway",
+
+	"describe": "describe",
+
+	"thumbnails.enabled": "thumbnails",
+	"thumbnails.dir":     "thumbnail-dir",
+	"thumbnails.size":    "thumbnail-size",
+
+	"publish.enabled":       "publish",
+	"publish.bucket":        "publish-bucket",
+	"publish.cache_control": "publish-cache-control",
+	"publish.acl":           "publish-acl",
+
+	"debug": "d",
+}
+
+// sectionKeys are the top level keys of the config file that are decoded
+// into fileConfig instead of flags.
+var sectionKeys = map[string]bool{
+	"mounts":       true,
+	"client_certs": true,
+	"auth":         true,
+	"authz":        true,
+}
+
+var (
+	// configMu guards the flag variables while a config is being applied.
+	configMu sync.RWMutex
+
+	// cliFlags holds the flags that were explicitly set on the command
+	// line, these always take precedence over the config file and
+	// environment.
+	cliFlags map[string]bool
+)
+
+// envName returns the environment variable name for a config key.
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// fileConfig holds the parts of the config file that do not map to flags.
+type fileConfig struct {
+	Mounts      []mountConfig    `yaml:"mounts"`
+	ClientCerts []clientCertRule `yaml:"client_certs"`
+	Auth        authConfig       `yaml:"auth"`
+	Authz       []authzRule      `yaml:"authz"`
+}
+
+// readConfigFile parses the YAML config file at path into a map of dotted
+// keys to values and the sections that do not map to flags.
+func readConfigFile(path string) (map[string]string, fileConfig, error) {
+	values := map[string]string{}
+	var fc fileConfig
+	if path == "" {
+		return values, fc, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fc, fmt.Errorf("reading config file %s failed: %v", path, err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fc, fmt.Errorf("parsing config file %s failed: %v", path, err)
+	}
+
+	// Decode the sections strictly on their own, so typos are caught.
+	sections := map[string]interface{}{}
+	for k, v := range raw {
+		if sectionKeys[k] {
+			sections[k] = v
+			delete(raw, k)
+		}
+	}
+	sb, err := yaml.Marshal(sections)
+	if err != nil {
+		return nil, fc, fmt.Errorf("parsing config file %s failed: %v", path, err)
+	}
+	if err := yaml.UnmarshalStrict(sb, &fc); err != nil {
+		return nil, fc, fmt.Errorf("parsing config file %s failed: %v", path, err)
+	}
+
+	if err := flattenConfig("", raw, values); err != nil {
+		return nil, fc, fmt.Errorf("parsing config file %s failed: %v", path, err)
+	}
+	return values, fc, nil
+}
+
+// flattenConfig flattens nested maps into dotted keys and checks that every
+// key is known.
+func flattenConfig(prefix string, raw map[string]interface{}, values map[string]string) error {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			m := map[string]interface{}{}
+			for mk, mv := range v {
+				m[fmt.Sprint(mk)] = mv
+			}
+			if err := flattenConfig(key, m, values); err != nil {
+				return err
+			}
+		default:
+			if _, ok := configKeys[key]; !ok {
+				return fmt.Errorf("unknown key %q", key)
+			}
+			if v == nil {
+				continue
+			}
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// loadConfig sets every flag that was not given on the command line from
+// the environment, then the config file, then its default. If the result
+// does not validate, the previous values are restored.
+func loadConfig(fs *flag.FlagSet) error {
+	values, fc, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if cliFlags == nil {
+		cliFlags = map[string]bool{}
+		fs.Visit(func(f *flag.Flag) {
+			cliFlags[f.Name] = true
+		})
+	}
+
+	keys := make([]string, 0, len(configKeys))
+	for k := range configKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	previous := map[string]string{}
+	for _, key := range keys {
+		name := configKeys[key]
+		f := fs.Lookup(name)
+		if f == nil || cliFlags[name] {
+			continue
+		}
+		previous[name] = f.Value.String()
+
+		value, ok := os.LookupEnv(envName(key))
+		if !ok {
+			value, ok = values[key]
+		}
+		if !ok {
+			value = f.DefValue
+		}
+
+		if err := fs.Set(name, value); err != nil {
+			restoreFlags(fs, previous)
+			return fmt.Errorf("setting %s failed: %v", key, err)
+		}
+	}
+
+	if err := validateFlags(); err != nil {
+		restoreFlags(fs, previous)
+		return err
+	}
+
+	if _, err := resolveMounts(fc.Mounts); err != nil {
+		restoreFlags(fs, previous)
+		return err
+	}
+	if err := validateClientCertRules(fc.ClientCerts); err != nil {
+		restoreFlags(fs, previous)
+		return err
+	}
+
+	if err := validateAuthzRules(fc.Authz); err != nil {
+		restoreFlags(fs, previous)
+		return err
+	}
+
+	// a public ACL lets uploads be read from the bucket around the rules
+	if len(fc.Authz) > 0 && publicACLs[uploadACL] && !uploadPublic {
+		restoreFlags(fs, previous)
+		return fmt.Errorf("upload-acl %s makes uploads readable around the authz rules, set upload-public to allow it", uploadACL)
+	}
+
+	a, err := newAuthState(fc.Auth)
+	if err != nil {
+		restoreFlags(fs, previous)
+		return fmt.Errorf("setting up auth failed: %v", err)
+	}
+
+	mountConfigs = fc.Mounts
+	clientCertRules = fc.ClientCerts
+	auth = a
+	authzRules = fc.Authz
+
+	return nil
+}
+
+func restoreFlags(fs *flag.FlagSet, values map[string]string) {
+	for name, value := range values {
+		fs.Set(name, value)
+	}
+}
+
+// watchConfig polls the config file at path and signals on reload
+// whenever its modification time changes.
+func watchConfig(path string, every time.Duration, reload chan<- string) {
+	var last time.Time
+	if fi, err := os.Stat(path); err == nil {
+		last = fi.ModTime()
+	}
+
+	for range time.Tick(every) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			logrus.Debugf("stat config file %s failed: %v", path, err)
+			continue
+		}
+		if !fi.ModTime().Equal(last) {
+			last = fi.ModTime()
+			reload <- "config file change"
+		}
+	}
+}
+
+// validateFlags checks the values of the flags.
+func validateFlags() error {
+	if provider != "s3" && provider != "gcs" && provider != "file" {
+		return fmt.Errorf("%s is not a valid provider, try `s3`, `gcs` or `file`", provider)
+	}
+
+	if interval <= 0 {
+		return fmt.Errorf("interval must be greater than 0, got %s", interval)
+	}
+
+	if readyIntervals < 1 {
+		return fmt.Errorf("ready-intervals must be at least 1, got %d", readyIntervals)
+	}
+
+	if traceSample < 0 || traceSample > 1 {
+		return fmt.Errorf("trace-sample must be between 0 and 1, got %v", traceSample)
+	}
+
+	if _, ok := tlsVersions[tlsMinVersion]; !ok {
+		return fmt.Errorf("%s is not a valid TLS version, try `1.2` or `1.3`", tlsMinVersion)
+	}
+
+	if _, ok := tlsCipherPolicies[tlsCiphers]; !ok {
+		return fmt.Errorf("%s is not a valid cipher policy, try `modern`, `intermediate` or `default`", tlsCiphers)
+	}
+
+	if accessLogFormat != "json" && accessLogFormat != "combined" {
+		return fmt.Errorf("%s is not a valid access log format, try `json` or `combined`", accessLogFormat)
+	}
+
+	if publicURL != "" {
+		u, err := url.Parse(publicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("public-url must be an http or https URL, got %s", publicURL)
+		}
+	}
+
+	if !uploadACLs[uploadACL] {
+		return fmt.Errorf("%s is not a valid upload ACL, try `private` or `public-read`", uploadACL)
+	}
+
+	if !uploadACLs[publishACL] {
+		return fmt.Errorf("%s is not a valid publish ACL, try `public-read` or `private`", publishACL)
+	}
+
+	if maxUploadSize < 0 {
+		return fmt.Errorf("max-upload-size must not be negative, got %d", maxUploadSize)
+	}
+
+	if maxArchiveSize < 0 {
+		return fmt.Errorf("max-archive-size must not be negative, got %d", maxArchiveSize)
+	}
+
+	if thumbnailSize < 1 {
+		return fmt.Errorf("thumbnail-size must be positive, got %d", thumbnailSize)
+	}
+
+	if webdavPath != "" && strings.Trim(webdavPath, "/") == "" {
+		return fmt.Errorf("webdav must not be served at /, got %s", webdavPath)
+	}
+
+	if s3GatewayPath != "" && strings.Trim(s3GatewayPath, "/") == "" {
+		return fmt.Errorf("s3-gateway must not be served at /, got %s", s3GatewayPath)
+	}
+
+	if uploadExpiry <= 0 {
+		return fmt.Errorf("upload-expiry must be greater than 0, got %s", uploadExpiry)
+	}
+
+	return nil
+}
+
+// listenerSettings returns the settings that only take effect on restart.
+func listenerSettings() string {
+	return strings.Join([]string{
+		address, port, tlsMinVersion, tlsCiphers, httpRedirect, clientCA,
+		accessLog, accessLogFormat, trustedProxies, otlpEndpoint, auditLogPath,
+		uploadDir, webdavPath, s3GatewayPath,
+	}, "\x00")
+}
+
+// applyRuntimeConfig applies the settings that can change without
+// restarting the server.
+func applyRuntimeConfig(exporter *otlpExporter) {
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+
+	if exporter != nil {
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(traceSample)})
+	}
+}
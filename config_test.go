@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFlagSet registers the flags that are read while serving, and sets
+// the other validated settings to their defaults.
+func testFlagSet() *flag.FlagSet {
+	provider, interval, readyIntervals = "s3", time.Minute, 3
+	tlsMinVersion, tlsCiphers, accessLogFormat = "1.2", "intermediate", "json"
+	publishACL, uploadExpiry = "public-read", time.Hour
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&templates, "templates", "", "")
+	fs.StringVar(&uploadACL, "upload-acl", "private", "")
+	fs.BoolVar(&uploadPublic, "upload-public", false, "")
+	fs.BoolVar(&describeObjects, "describe", false, "")
+	fs.BoolVar(&thumbnails, "thumbnails", false, "")
+	fs.IntVar(&thumbnailSize, "thumbnail-size", 200, "")
+	fs.BoolVar(&publish, "publish", false, "")
+	fs.StringVar(&publishBucket, "publish-bucket", "", "")
+	fs.StringVar(&publishCacheControl, "publish-cache-control", "public, max-age=60", "")
+	return fs
+}
+
+func TestLoadConfigReloadWhileServing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile = filepath.Join(dir, "config.yml")
+	defer func() { configFile = "" }()
+	cliFlags = nil
+	fs := testFlagSet()
+
+	configs := []string{
+		"templates: /a\ndescribe: true\nthumbnails:\n  enabled: true\npublish:\n  cache_control: no-cache\n",
+		"templates: /b\n",
+	}
+	for i, c := range configs {
+		if err := ioutil.WriteFile(configFile, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(fs); err != nil {
+			t.Fatalf("config %d: %v", i, err)
+		}
+	}
+	if got := templateDir("static"); got != "/b" {
+		t.Errorf("templates: got %s, want /b", got)
+	}
+	if describeObjects || thumbnails {
+		t.Error("describe and thumbnails should be reset to their defaults")
+	}
+
+	// readers of the settings race with reloads under -race if they do not
+	// hold configMu
+	m := &mount{name: "default", p: newFakeCloud("/", nil)}
+	var wg sync.WaitGroup
+	started, stop := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			templateDir("static")
+			m.data(nil, "", false)
+			mountSettings()
+			if i == 0 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 50; i++ {
+		if err := loadConfig(fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestLoadConfigPublicUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile = filepath.Join(dir, "config.yml")
+	defer func() { configFile = "" }()
+	cliFlags = nil
+	fs := testFlagSet()
+	defer func() {
+		configMu.Lock()
+		authzRules = nil
+		configMu.Unlock()
+	}()
+
+	rules := "authz:\n  - prefix: public/\n    everyone: true\n"
+	for _, c := range []struct {
+		config string
+		ok     bool
+	}{
+		{"upload:\n  acl: public-read\n", true},
+		{rules, true},
+		{rules + "upload:\n  acl: public-read\n", false},
+		{rules + "upload:\n  acl: public-read\n  public: true\n", true},
+	} {
+		if err := ioutil.WriteFile(configFile, []byte(c.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := loadConfig(fs)
+		if (err == nil) != c.ok {
+			t.Errorf("config %q: got %v, want ok %v", c.config, err, c.ok)
+		}
+		// a refused config leaves the ACL as it was
+		if err != nil && uploadACL != "private" {
+			t.Errorf("config %q: got upload ACL %s after the error", c.config, uploadACL)
+		}
+	}
+}
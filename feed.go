@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// feedEntries is the most objects a feed lists.
+const feedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// writeFeed writes an Atom feed of the newest objects in files, newest
+// first. siteURL is where the mount's index is served, if it is known; it
+// becomes the feed's ID and links.
+func (m *mount) writeFeed(w io.Writer, files []object, siteURL string) error {
+	var entries []object
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name, "/") {
+			entries = append(entries, f)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Modified.After(entries[j].Modified) })
+	if len(entries) > feedEntries {
+		entries = entries[:feedEntries]
+	}
+
+	feed := atomFeed{
+		Title:   m.name,
+		ID:      "urn:s3server:" + url.PathEscape(m.name),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if siteURL != "" {
+		siteURL = strings.TrimSuffix(siteURL, "/") + "/"
+		feed.ID = siteURL
+		feed.Links = []atomLink{
+			{Href: siteURL},
+			{Href: siteURL + "feed.xml", Rel: "self", Type: "application/atom+xml"},
+		}
+	}
+	if len(entries) > 0 {
+		feed.Updated = entries[0].Modified.UTC().Format(time.RFC3339)
+	}
+
+	for _, f := range entries {
+		e := atomEntry{
+			Title:   f.Title,
+			ID:      feed.ID + "#" + escapeKeyPath(f.Name),
+			Updated: f.Modified.UTC().Format(time.RFC3339),
+			Summary: f.Description,
+		}
+		if e.Title == "" {
+			e.Title = f.Name
+		}
+		if f.BaseURL != "" {
+			e.ID = "https://" + f.BaseURL + "/" + escapeKeyPath(f.Name)
+			e.Links = []atomLink{{Href: e.ID, Type: contentTypeFor(f.Name, f.ContentType)}}
+		}
+		for _, t := range f.Tags {
+			e.Categories = append(e.Categories, atomCategory{Term: t})
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(feed)
+}
+
+// createFeed writes the feed of the objects anyone may read in the mount's
+// listing to path.
+func (m *mount) createFeed(path, siteURL string) error {
+	files, _ := m.listing()
+	configMu.RLock()
+	describe, rules := describeObjects, authzRules
+	configMu.RUnlock()
+	if describe {
+		files = withoutDescriptions(files)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating feed failed: %v", err)
+	}
+	if err := m.writeFeed(f, m.publicObjects(rules, files), siteURL); err != nil {
+		f.Close()
+		return fmt.Errorf("writing feed failed: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWriteFeed(t *testing.T) {
+	m := &mount{name: "gifs", p: newFakeCloud("/", nil)}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []object{
+		{Name: "old.gif", BaseURL: "bucket.example.com", Modified: base},
+		{Name: "reactions/", Modified: base.Add(time.Hour)},
+		{Name: "new dance.gif", BaseURL: "bucket.example.com", Modified: base.Add(2 * time.Hour), Title: "Dance", Description: "<b>dancing</b>", Tags: []string{"happy"}},
+		{Name: "middle.gif", BaseURL: "bucket.example.com", Modified: base.Add(time.Minute)},
+	}
+	for i := 0; i < feedEntries; i++ {
+		files = append(files, object{Name: fmt.Sprintf("older/%d.gif", i), BaseURL: "bucket.example.com", Modified: base.Add(-time.Hour)})
+	}
+
+	var b bytes.Buffer
+	if err := m.writeFeed(&b, files, "https://gifs.example.com/gifs"); err != nil {
+		t.Fatal(err)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(b.Bytes(), &feed); err != nil {
+		t.Fatalf("the feed is not valid XML: %v\n%s", err, b.String())
+	}
+
+	if feed.ID != "https://gifs.example.com/gifs/" || feed.Updated != "2020-01-01T02:00:00Z" {
+		t.Errorf("got feed ID %q updated %q", feed.ID, feed.Updated)
+	}
+	if len(feed.Entries) != feedEntries {
+		t.Fatalf("got %d entries, want %d", len(feed.Entries), feedEntries)
+	}
+	for i, want := range []string{"Dance", "middle.gif", "old.gif"} {
+		if feed.Entries[i].Title != want {
+			t.Errorf("entry %d: got %q, want %q", i, feed.Entries[i].Title, want)
+		}
+	}
+	first := feed.Entries[0]
+	if first.ID != "https://bucket.example.com/new%20dance.gif" || len(first.Links) != 1 || first.Links[0].Type != "image/gif" {
+		t.Errorf("got first entry %+v", first)
+	}
+	if first.Summary != "<b>dancing</b>" || len(first.Categories) != 1 || first.Categories[0].Term != "happy" {
+		t.Errorf("got first entry %+v", first)
+	}
+	if bytes.Contains(b.Bytes(), []byte("<b>")) {
+		t.Errorf("the description is not escaped:\n%s", b.String())
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// fsUploadDir is the directory under the root that resumable uploads keep
+// their parts in. It is left out of listings.
+const fsUploadDir = ".s3server-uploads"
+
+// fsProvider serves a local directory as a bucket. Objects are files named
+// by their key, and folders without files are listed as `<name>/`
+// placeholders like in the cloud providers. The directory is not served
+// over HTTP on its own, so objects are linked through the object handler.
+type fsProvider struct {
+	root string
+}
+
+func newFSProvider(bucket string) (*fsProvider, error) {
+	root := filepath.Clean(strings.TrimPrefix(bucket, "file://"))
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &fsProvider{root: root}, nil
+}
+
+// path returns the file for a key. Keys that would leave the root are
+// rejected.
+func (c *fsProvider) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasPrefix(clean, "/"+fsUploadDir) || clean != "/"+strings.TrimSuffix(key, "/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(c.root, filepath.FromSlash(clean)), nil
+}
+
+func (c *fsProvider) object(key string, fi os.FileInfo) object {
+	o := object{Name: key, Modified: fi.ModTime()}
+	if !fi.IsDir() {
+		o.Size = fi.Size()
+	}
+	return o
+}
+
+// List returns the files in the directory with keys starting with prefix.
+func (c *fsProvider) List(ctx context.Context, prefix, delimiter, marker string, max int, q *storage.Query) (files []object, err error) {
+	start := time.Now()
+	defer func() { observeProviderCall("file", "list", start, err) }()
+
+	prefix = strings.TrimPrefix(prefix, "/")
+	err = filepath.Walk(c.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if fi.IsDir() {
+			if key == fsUploadDir {
+				return filepath.SkipDir
+			}
+			// only empty folders need a placeholder
+			entries, err := ioutil.ReadDir(p)
+			if err != nil || len(entries) > 0 {
+				return err
+			}
+			key += "/"
+		} else if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, c.object(key, fi))
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, err
+}
+
+// Open returns a reader for a file in the directory.
+func (c *fsProvider) Open(ctx context.Context, key string) (io.ReadCloser, object, error) {
+	return c.OpenRange(ctx, key, 0)
+}
+
+// OpenRange returns a reader for a file in the directory from offset on.
+func (c *fsProvider) OpenRange(ctx context.Context, key string, offset int64) (_ io.ReadCloser, _ object, err error) {
+	start := time.Now()
+	defer func() { observeProviderCall("file", "get", start, err) }()
+
+	p, err := c.path(key)
+	if err != nil {
+		return nil, object{}, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, object{}, err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("%s is a folder", key)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, object{}, err
+	}
+	return f, c.object(key, fi), nil
+}
+
+// Stat describes a file in the directory.
+func (c *fsProvider) Stat(ctx context.Context, key string) (object, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return object{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return object{}, err
+	}
+	return c.object(key, fi), nil
+}
+
+// writeFile writes r to the file for key through a temporary file, so
+// readers never see part of it.
+func (c *fsProvider) writeFile(key string, r io.Reader) (object, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return object{}, err
+	}
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return object{}, err
+		}
+		return object{Name: key, Modified: time.Now()}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return object{}, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".s3server-")
+	if err != nil {
+		return object{}, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return object{}, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return object{}, err
+	}
+	if err := f.Close(); err != nil {
+		return object{}, err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return object{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return object{}, err
+	}
+	return c.object(key, fi), nil
+}
+
+// Put writes an object to the directory. The content type is not stored,
+// objects are typed by their extension.
+func (c *fsProvider) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (o object, err error) {
+	start := time.Now()
+	defer func() { observeProviderCall("file", "put", start, err) }()
+
+	o, err = c.writeFile(key, r)
+	o.ContentType = contentType
+	return o, err
+}
+
+// Publish writes a small generated file, such as an index page, to the
+// directory.
+func (c *fsProvider) Publish(ctx context.Context, key string, data []byte, contentType, cacheControl string) error {
+	_, err := c.writeFile(key, bytes.NewReader(data))
+	return err
+}
+
+// Metadata returns no metadata, files have none, or an error if there is no
+// file for the key.
+func (c *fsProvider) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, nil
+}
+
+// Delete removes files, and empty folders, from the directory. Keys that
+// do not exist are ignored, as with the cloud providers.
+func (c *fsProvider) Delete(ctx context.Context, keys ...string) error {
+	for _, k := range keys {
+		p, err := c.path(k)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copies a file within the directory.
+func (c *fsProvider) Copy(ctx context.Context, src, dst string) (object, error) {
+	body, _, err := c.Open(ctx, src)
+	if err != nil {
+		return object{}, err
+	}
+	defer body.Close()
+	return c.writeFile(dst, body)
+}
+
+// Move renames a file within the directory.
+func (c *fsProvider) Move(ctx context.Context, src, dst string) (object, error) {
+	from, err := c.path(src)
+	if err != nil {
+		return object{}, err
+	}
+	to, err := c.path(dst)
+	if err != nil {
+		return object{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return object{}, err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return object{}, err
+	}
+	fi, err := os.Stat(to)
+	if err != nil {
+		return object{}, err
+	}
+	return c.object(dst, fi), nil
+}
+
+// uploadPath returns the folder holding the parts of a resumable upload.
+func (c *fsProvider) uploadPath(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+	return filepath.Join(c.root, fsUploadDir, uploadID), nil
+}
+
+// InitUpload starts a resumable upload and returns its upload ID.
+func (c *fsProvider) InitUpload(ctx context.Context, key, contentType string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	p, _ := c.uploadPath(id)
+	return id, os.MkdirAll(p, 0755)
+}
+
+// UploadPart writes part n of a resumable upload.
+func (c *fsProvider) UploadPart(ctx context.Context, key, uploadID string, n int, offset int64, r io.ReadSeeker, size, total int64) (string, error) {
+	p, err := c.uploadPath(uploadID)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return "", ioutil.WriteFile(filepath.Join(p, strconv.Itoa(n)), b, 0644)
+}
+
+// CompleteUpload puts the parts of a resumable upload together into the
+// file for key.
+func (c *fsProvider) CompleteUpload(ctx context.Context, key, uploadID string, parts []uploadPart) (object, error) {
+	p, err := c.uploadPath(uploadID)
+	if err != nil {
+		return object{}, err
+	}
+
+	var files []io.Reader
+	for _, part := range parts {
+		f, err := os.Open(filepath.Join(p, strconv.Itoa(part.N)))
+		if err != nil {
+			return object{}, err
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	o, err := c.writeFile(key, io.MultiReader(files...))
+	if err != nil {
+		return object{}, err
+	}
+	return o, os.RemoveAll(p)
+}
+
+// AbortUpload removes the parts of a resumable upload.
+func (c *fsProvider) AbortUpload(ctx context.Context, key, uploadID string) error {
+	p, err := c.uploadPath(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// Prefix returns "/", the directory is the whole bucket.
+func (c *fsProvider) Prefix() string {
+	return "/"
+}
+
+// BaseURL returns "", the directory has no URL of its own.
+func (c *fsProvider) BaseURL() string {
+	return ""
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFSProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, err := newFSProvider("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, key := range []string{"reactions/dance.gif", "notes.txt"} {
+		if _, err := p.Put(ctx, key, strings.NewReader("0123456789"), 10, ""); err != nil {
+			t.Fatalf("putting %s failed: %v", key, err)
+		}
+	}
+	if _, err := p.Put(ctx, "empty/", strings.NewReader(""), 0, ""); err != nil {
+		t.Fatalf("putting a folder failed: %v", err)
+	}
+	for _, key := range []string{"../outside.gif", "a/../../outside.gif", "a//b.gif", fsUploadDir + "/x"} {
+		if _, err := p.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("putting %s: expected an error", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "outside.gif")); err == nil {
+		t.Error("a key wrote outside of the directory")
+	}
+
+	files, err := p.List(ctx, "/", "", "", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "empty/,notes.txt,reactions/dance.gif" {
+		t.Errorf("got listing %s", got)
+	}
+
+	body, o, err := p.OpenRange(ctx, "reactions/dance.gif", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(b) != "789" || o.Size != 10 {
+		t.Errorf("reading from 7: got %q of %d bytes", b, o.Size)
+	}
+
+	if _, err := p.Move(ctx, "notes.txt", "archive/notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Metadata(ctx, "notes.txt"); !os.IsNotExist(err) {
+		t.Errorf("moved file: got %v, want not found", err)
+	}
+	if err := p.Delete(ctx, "archive/notes.txt", "missing.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := p.InitUpload(ctx, "big.bin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, part := range []string{"abc", "def"} {
+		if _, err := p.UploadPart(ctx, "big.bin", id, n+1, int64(n*3), strings.NewReader(part), 3, 6); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.CompleteUpload(ctx, "big.bin", id, []uploadPart{{N: 1, Size: 3}, {N: 2, Size: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "big.bin")); err != nil || !bytes.Equal(b, []byte("abcdef")) {
+		t.Errorf("completed upload: got %q, %v", b, err)
+	}
+	if _, err := p.UploadPart(ctx, "big.bin", "../../etc", 1, 0, strings.NewReader("x"), 1, 1); err == nil {
+		t.Error("uploading a part with a path as upload ID: expected an error")
+	}
+}
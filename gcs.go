@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/iterator"
 )
 
@@ -12,33 +23,400 @@ type gcsProvider struct {
 	prefix  string
 	baseURL string
 	client  *storage.Client
+	hc      *http.Client
 	ctx     context.Context
 	b       *storage.BucketHandle
 }
 
 // List returns the files in an gcs bucket.
-func (c *gcsProvider) List(prefix, delimiter, marker string, max int, q *storage.Query) (files []object, err error) {
-	resp := c.b.Objects(c.ctx, q)
+func (c *gcsProvider) List(ctx context.Context, prefix, delimiter, marker string, max int, q *storage.Query) (files []object, err error) {
+	pager := iterator.NewPager(c.b.Objects(ctx, q), max, marker)
 
-	// append to files
+	// append to files, one page at a time
 	for {
-		f, err := resp.Next()
-		if err == iterator.Done {
-			break
-		}
+		attrs, token, err := c.listPage(ctx, pager)
 		if err != nil {
 			return nil, err
 		}
-		files = append(files, object{
-			Name:    f.Name,
-			Size:    f.Size,
-			BaseURL: c.BaseURL(),
-		})
+
+		for _, f := range attrs {
+			// the listing has the metadata, even if there is none
+			md := f.Metadata
+			if md == nil {
+				md = map[string]string{}
+			}
+			files = append(files, object{
+				Name:     f.Name,
+				Size:     f.Size,
+				BaseURL:  c.BaseURL(),
+				Modified: f.Updated,
+				ETag:     hex.EncodeToString(f.MD5),
+				Metadata: md,
+			})
+		}
+
+		if token == "" {
+			break
+		}
 	}
 
 	return files, nil
 }
 
+// listPage fetches the next page of objects from the pager.
+func (c *gcsProvider) listPage(ctx context.Context, pager *iterator.Pager) ([]*storage.ObjectAttrs, string, error) {
+	_, span := trace.StartSpan(ctx, "gcs.List", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("bucket", c.bucket))
+
+	var attrs []*storage.ObjectAttrs
+	start := time.Now()
+	token, err := pager.NextPage(&attrs)
+	observeProviderCall("gcs", "list", start, err)
+	setSpanError(span, err)
+	span.AddAttributes(trace.Int64Attribute("objects", int64(len(attrs))))
+
+	return attrs, token, err
+}
+
+// Open returns a reader for an object in an gcs bucket.
+func (c *gcsProvider) Open(ctx context.Context, key string) (io.ReadCloser, object, error) {
+	return c.OpenRange(ctx, key, 0)
+}
+
+// OpenRange returns a reader for an object in an gcs bucket from offset on.
+func (c *gcsProvider) OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, object, error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Get", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key), trace.Int64Attribute("offset", offset))
+
+	start := time.Now()
+	r, err := c.b.Object(key).NewRangeReader(ctx, offset, -1)
+	observeProviderCall("gcs", "get", start, err)
+	setSpanError(span, err)
+	if err != nil {
+		return nil, object{}, err
+	}
+
+	return r, object{
+		Name:        key,
+		Size:        r.Size(),
+		BaseURL:     c.BaseURL(),
+		ContentType: r.ContentType(),
+	}, nil
+}
+
+// Put uploads an object to an gcs bucket. The writer uses a resumable
+// upload session, sending the object in chunks.
+func (c *gcsProvider) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (o object, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Put", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "put", start, err)
+		setSpanError(span, err)
+	}()
+
+	w := c.b.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := io.Copy(w, r); err != nil {
+		w.CloseWithError(err)
+		return object{}, err
+	}
+	if err := w.Close(); err != nil {
+		return object{}, err
+	}
+
+	attrs := w.Attrs()
+	return object{
+		Name:        key,
+		Size:        attrs.Size,
+		BaseURL:     c.BaseURL(),
+		ContentType: attrs.ContentType,
+		Modified:    attrs.Updated,
+	}, nil
+}
+
+// gcsACL returns the object ACL for a canned s3 ACL. ACLs that do not grant
+// reads to others keep the bucket's default object ACL.
+func gcsACL(canned string) []storage.ACLRule {
+	switch canned {
+	case "public-read", "public-read-write":
+		return []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	case "authenticated-read":
+		return []storage.ACLRule{{Entity: storage.AllAuthenticatedUsers, Role: storage.RoleReader}}
+	}
+	return nil
+}
+
+// Publish uploads a small generated file, such as an index page, to an gcs
+// bucket with the given headers and the publish ACL.
+func (c *gcsProvider) Publish(ctx context.Context, key string, data []byte, contentType, cacheControl string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Publish", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "publish", start, err)
+		setSpanError(span, err)
+	}()
+
+	w := c.b.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.CacheControl = cacheControl
+	w.ACL = gcsACL(currentPublishACL())
+	if _, err := w.Write(data); err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+	return w.Close()
+}
+
+// Delete removes objects from an gcs bucket.
+func (c *gcsProvider) Delete(ctx context.Context, keys ...string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Delete", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.Int64Attribute("keys", int64(len(keys))))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "delete", start, err)
+		setSpanError(span, err)
+	}()
+
+	for _, k := range keys {
+		if err := c.b.Object(k).Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metadata returns the custom metadata of an object in a gcs bucket.
+func (c *gcsProvider) Metadata(ctx context.Context, key string) (md map[string]string, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Attrs", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "attrs", start, err)
+		setSpanError(span, err)
+	}()
+
+	attrs, err := c.b.Object(key).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return attrs.Metadata, nil
+}
+
+// Stat describes an object in a gcs bucket from its attributes.
+func (c *gcsProvider) Stat(ctx context.Context, key string) (o object, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Attrs", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "attrs", start, err)
+		setSpanError(span, err)
+	}()
+
+	attrs, err := c.b.Object(key).Attrs(ctx)
+	if err != nil {
+		return object{}, err
+	}
+	return object{
+		Name:        key,
+		Size:        attrs.Size,
+		BaseURL:     c.BaseURL(),
+		ContentType: attrs.ContentType,
+		Modified:    attrs.Updated,
+		ETag:        hex.EncodeToString(attrs.MD5),
+		Metadata:    attrs.Metadata,
+	}, nil
+}
+
+// Copy copies an object within an gcs bucket.
+func (c *gcsProvider) Copy(ctx context.Context, src, dst string) (o object, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.Copy", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("source", src),
+		trace.StringAttribute("destination", dst),
+	)
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "copy", start, err)
+		setSpanError(span, err)
+	}()
+
+	attrs, err := c.b.Object(dst).CopierFrom(c.b.Object(src)).Run(ctx)
+	if err != nil {
+		return object{}, err
+	}
+
+	return object{
+		Name:        dst,
+		Size:        attrs.Size,
+		BaseURL:     c.BaseURL(),
+		ContentType: attrs.ContentType,
+		Modified:    attrs.Updated,
+	}, nil
+}
+
+// Move copies an object within an gcs bucket and deletes the original.
+func (c *gcsProvider) Move(ctx context.Context, src, dst string) (object, error) {
+	o, err := c.Copy(ctx, src, dst)
+	if err != nil {
+		return object{}, err
+	}
+	return o, c.Delete(ctx, src)
+}
+
+// gcsUploadURL is the JSON API endpoint resumable upload sessions are
+// started at.
+const gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s"
+
+// InitUpload starts a resumable upload session to an gcs bucket and
+// returns the session URI.
+func (c *gcsProvider) InitUpload(ctx context.Context, key, contentType string) (uri string, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.InitUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "init_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	body, err := json.Marshal(map[string]string{"contentType": contentType})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(gcsUploadURL, url.PathEscape(c.bucket), url.QueryEscape(key)), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", contentType)
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("starting upload session failed: %s: %s", resp.Status, b)
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// UploadPart sends part n of a resumable upload to an gcs bucket. Every
+// part but the last must be a multiple of 256KiB.
+func (c *gcsProvider) UploadPart(ctx context.Context, key, uri string, n int, offset int64, r io.ReadSeeker, size, total int64) (etag string, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.UploadPart", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("key", key),
+		trace.Int64Attribute("part", int64(n)),
+	)
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "upload_part", start, err)
+		setSpanError(span, err)
+	}()
+
+	length := "*"
+	if offset+size == total {
+		length = strconv.FormatInt(total, 10)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, uri, ioutil.NopCloser(r))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+size-1, length))
+
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// 308 means the session is waiting for more parts.
+	if resp.StatusCode != http.StatusPermanentRedirect && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("uploading part %d failed: %s: %s", n, resp.Status, b)
+	}
+	return "", nil
+}
+
+// CompleteUpload returns the object of a finished resumable upload to an
+// gcs bucket. The session completes with its last part.
+func (c *gcsProvider) CompleteUpload(ctx context.Context, key, uri string, parts []uploadPart) (o object, err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.CompleteUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "complete_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	attrs, err := c.b.Object(key).Attrs(ctx)
+	if err != nil {
+		return object{}, err
+	}
+
+	return object{
+		Name:        key,
+		Size:        attrs.Size,
+		BaseURL:     c.BaseURL(),
+		ContentType: attrs.ContentType,
+		Modified:    attrs.Updated,
+	}, nil
+}
+
+// AbortUpload cancels a resumable upload session to an gcs bucket.
+func (c *gcsProvider) AbortUpload(ctx context.Context, key, uri string) (err error) {
+	ctx, span := trace.StartSpan(ctx, "gcs.AbortUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("gcs", "abort_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	req, err := http.NewRequest(http.MethodDelete, uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// A cancelled session answers with 499.
+	if resp.StatusCode != 499 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("cancelling upload session failed: %s", resp.Status)
+	}
+	return nil
+}
+
 // Prefix returns the prefix in an gcs bucket.
 func (c *gcsProvider) Prefix() string {
 	return c.prefix
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestGCSACL(t *testing.T) {
+	for canned, want := range map[string]storage.ACLEntity{
+		"public-read":               storage.AllUsers,
+		"authenticated-read":        storage.AllAuthenticatedUsers,
+		"private":                   "",
+		"bucket-owner-full-control": "",
+	} {
+		acl := gcsACL(canned)
+		if want == "" {
+			if acl != nil {
+				t.Errorf("%s: got %v, want the bucket's default", canned, acl)
+			}
+			continue
+		}
+		if len(acl) != 1 || acl[0].Entity != want || acl[0].Role != storage.RoleReader {
+			t.Errorf("%s: got %v, want %s as reader", canned, acl, want)
+		}
+	}
+}
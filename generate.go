@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const generateHelp = `Write the static site for every mount to a directory and exit.`
+
+// generateCommand lists every mount once and writes its index and feed, the
+// landing page and the assets to a directory that can be served by any static web
+// server.
+type generateCommand struct {
+	output string
+	url    string
+}
+
+func (cmd *generateCommand) Name() string      { return "generate" }
+func (cmd *generateCommand) Args() string      { return "" }
+func (cmd *generateCommand) ShortHelp() string { return generateHelp }
+func (cmd *generateCommand) LongHelp() string  { return generateHelp }
+func (cmd *generateCommand) Hidden() bool      { return false }
+
+func (cmd *generateCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.output, "o", "site", "directory to write the site to")
+	fs.StringVar(&cmd.url, "url", "", "URL the site is served at, for the links in the feeds")
+}
+
+func (cmd *generateCommand) Run(ctx context.Context, args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("getting working directory failed: %v", err)
+	}
+	staticDir := filepath.Join(wd, "static")
+
+	configMu.RLock()
+	configs, err := resolveMounts(mountConfigs)
+	configMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := copyAssets(cmd.output, staticDir); err != nil {
+		return err
+	}
+
+	ms := make([]*mount, 0, len(configs))
+	for _, c := range configs {
+		m, err := newMount(c, staticDir)
+		if err != nil {
+			return err
+		}
+		m.index = filepath.Join(cmd.output, filepath.FromSlash(c.Path), "index.html")
+		m.readOnly = true
+		m.publish = nil
+		if err := os.MkdirAll(filepath.Dir(m.index), 0755); err != nil {
+			return fmt.Errorf("mount %q: creating index directory failed: %v", m.name, err)
+		}
+		if err := m.createStaticIndex(ctx); err != nil {
+			return fmt.Errorf("mount %q: creating static index failed: %v", m.name, err)
+		}
+		siteURL := ""
+		if cmd.url != "" {
+			siteURL = strings.TrimSuffix(cmd.url, "/") + m.path
+		}
+		if err := m.createFeed(filepath.Join(filepath.Dir(m.index), "feed.xml"), siteURL); err != nil {
+			return fmt.Errorf("mount %q: %v", m.name, err)
+		}
+		ms = append(ms, m)
+	}
+
+	if err := createLandingPage(staticDir, cmd.output, ms); err != nil {
+		return err
+	}
+
+	logrus.Infof("wrote the site for %d mounts to %s", len(ms), cmd.output)
+	return nil
+}
+
+// copyAssets copies the static assets to dst.
+func copyAssets(dst, staticDir string) error {
+	files, err := assetFiles(staticDir)
+	if err != nil {
+		return err
+	}
+	for _, rel := range files {
+		if err := copyFile(filepath.Join(dst, filepath.FromSlash(rel)), filepath.Join(staticDir, filepath.FromSlash(rel))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	df, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(df, sf); err != nil {
+		df.Close()
+		return fmt.Errorf("copying %s failed: %v", src, err)
+	}
+	return df.Close()
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"cloud.google.com/go/storage"
+	units "github.com/docker/go-units"
+)
+
+const (
+	lsHelp   = `List the objects and folders under a prefix of a mount.`
+	statHelp = `Show the size, type and modification time of objects.`
+	duHelp   = `Show the total size of the folders under a prefix of a mount.`
+)
+
+// inspectFlags are the flags of the commands that inspect a bucket with
+// the same provider and credentials as the server.
+type inspectFlags struct {
+	mount  string
+	format string
+	match  string
+}
+
+func (f *inspectFlags) register(fs *flag.FlagSet, match bool) {
+	fs.StringVar(&f.mount, "mount", "", "name of the mount to inspect, defaults to the first one")
+	fs.StringVar(&f.format, "format", "table", "output format (ex. table, json, csv)")
+	if match {
+		fs.StringVar(&f.match, "match", "", "glob the object names must match, against the whole key if it has a slash (ex. *.gif)")
+	}
+}
+
+// inspectRow is a line of output: an object, a folder or a total.
+type inspectRow struct {
+	Name        string    `json:"name"`
+	Objects     int       `json:"objects"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	Modified    time.Time `json:"modified"`
+}
+
+func (r *inspectRow) add(o object) {
+	r.Objects++
+	r.Size += o.Size
+	if o.Modified.After(r.Modified) {
+		r.Modified = o.Modified
+	}
+}
+
+// lsCommand lists the objects directly under a prefix and the folders with
+// their totals, or every object below it.
+type lsCommand struct {
+	inspectFlags
+	recursive bool
+}
+
+func (cmd *lsCommand) Name() string      { return "ls" }
+func (cmd *lsCommand) Args() string      { return "[prefix]" }
+func (cmd *lsCommand) ShortHelp() string { return lsHelp }
+func (cmd *lsCommand) LongHelp() string  { return lsHelp }
+func (cmd *lsCommand) Hidden() bool      { return false }
+
+func (cmd *lsCommand) Register(fs *flag.FlagSet) {
+	cmd.register(fs, true)
+	fs.BoolVar(&cmd.recursive, "r", false, "list every object below the prefix instead of folders")
+}
+
+func (cmd *lsCommand) Run(ctx context.Context, args []string) error {
+	m, prefix, err := inspectTarget(cmd.mount, args)
+	if err != nil {
+		return err
+	}
+	files, err := inspectList(ctx, m, prefix, cmd.match)
+	if err != nil {
+		return err
+	}
+
+	var rows []inspectRow
+	folders := map[string]int{}
+	for _, f := range files {
+		rest := f.Name[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 && !cmd.recursive {
+			name := prefix + rest[:i+1]
+			n, ok := folders[name]
+			if !ok {
+				n = len(rows)
+				folders[name] = n
+				rows = append(rows, inspectRow{Name: name})
+			}
+			rows[n].add(f)
+			continue
+		}
+		rows = append(rows, inspectRow{Name: f.Name, Objects: 1, Size: f.Size, Modified: f.Modified})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+
+	return writeRows(os.Stdout, cmd.format, rows, "name", "size", "objects", "modified")
+}
+
+// statCommand describes objects by key.
+type statCommand struct {
+	inspectFlags
+}
+
+func (cmd *statCommand) Name() string      { return "stat" }
+func (cmd *statCommand) Args() string      { return "<key>..." }
+func (cmd *statCommand) ShortHelp() string { return statHelp }
+func (cmd *statCommand) LongHelp() string  { return statHelp }
+func (cmd *statCommand) Hidden() bool      { return false }
+
+func (cmd *statCommand) Register(fs *flag.FlagSet) {
+	cmd.register(fs, false)
+}
+
+func (cmd *statCommand) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("stat needs at least one key")
+	}
+	m, _, err := inspectTarget(cmd.mount, nil)
+	if err != nil {
+		return err
+	}
+
+	var rows []inspectRow
+	for _, rel := range args {
+		key, err := m.objectKey(m.bucketKey(strings.TrimPrefix(rel, "/")))
+		if err != nil {
+			return err
+		}
+		o, err := m.p.Stat(ctx, key)
+		if err != nil {
+			return fmt.Errorf("stat %s failed: %v", key, err)
+		}
+		rows = append(rows, inspectRow{
+			Name:        rel,
+			Objects:     1,
+			Size:        o.Size,
+			ContentType: contentTypeFor(key, o.ContentType),
+			Modified:    o.Modified,
+		})
+	}
+
+	return writeRows(os.Stdout, cmd.format, rows, "name", "size", "type", "modified")
+}
+
+// duCommand totals the objects under a prefix by folder, or by extension.
+type duCommand struct {
+	inspectFlags
+	byExt bool
+}
+
+func (cmd *duCommand) Name() string      { return "du" }
+func (cmd *duCommand) Args() string      { return "[prefix]" }
+func (cmd *duCommand) ShortHelp() string { return duHelp }
+func (cmd *duCommand) LongHelp() string  { return duHelp }
+func (cmd *duCommand) Hidden() bool      { return false }
+
+func (cmd *duCommand) Register(fs *flag.FlagSet) {
+	cmd.register(fs, true)
+	fs.BoolVar(&cmd.byExt, "by-ext", false, "total by file extension instead of by folder")
+}
+
+func (cmd *duCommand) Run(ctx context.Context, args []string) error {
+	m, prefix, err := inspectTarget(cmd.mount, args)
+	if err != nil {
+		return err
+	}
+	files, err := inspectList(ctx, m, prefix, cmd.match)
+	if err != nil {
+		return err
+	}
+
+	groups := map[string]*inspectRow{}
+	total := inspectRow{Name: "total"}
+	for _, f := range files {
+		// objects directly under the prefix are totaled as the prefix
+		name := prefix
+		if name == "" {
+			name = "."
+		}
+		if cmd.byExt {
+			name = strings.ToLower(strings.TrimPrefix(path.Ext(f.Name), "."))
+			if name == "" {
+				name = "(none)"
+			}
+		} else if i := strings.Index(f.Name[len(prefix):], "/"); i >= 0 {
+			name = f.Name[:len(prefix)+i+1]
+		}
+		if groups[name] == nil {
+			groups[name] = &inspectRow{Name: name}
+		}
+		groups[name].add(f)
+		total.add(f)
+	}
+
+	rows := make([]inspectRow, 0, len(groups)+1)
+	for _, r := range groups {
+		rows = append(rows, *r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if cmd.byExt && rows[i].Size != rows[j].Size {
+			return rows[i].Size > rows[j].Size
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	rows = append(rows, total)
+
+	return writeRows(os.Stdout, cmd.format, rows, "name", "size", "objects", "modified")
+}
+
+// inspectTarget returns the mount with the name, or the first one, and the
+// prefix in the args relative to its bucket prefix.
+func inspectTarget(name string, args []string) (*mount, string, error) {
+	if len(args) > 1 {
+		return nil, "", fmt.Errorf("expected at most one prefix, got %d", len(args))
+	}
+
+	configMu.RLock()
+	configs, err := resolveMounts(mountConfigs)
+	configMu.RUnlock()
+	if err != nil {
+		return nil, "", err
+	}
+
+	c := configs[0]
+	if name != "" {
+		found := false
+		for _, mc := range configs {
+			if mc.Name == name {
+				c, found = mc, true
+				break
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("unknown mount %q", name)
+		}
+	}
+
+	p, err := newProvider(c.Provider, c.Bucket, c.S3.Region, c.S3.Key, c.S3.Secret)
+	if err != nil {
+		return nil, "", fmt.Errorf("mount %q: creating new provider failed: %v", c.Name, err)
+	}
+	m := &mount{name: c.Name, path: c.Path, provider: c.Provider, p: p}
+
+	var prefix string
+	if len(args) == 1 {
+		prefix = strings.TrimPrefix(args[0], "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+	return m, prefix, nil
+}
+
+// inspectList returns the objects below the prefix that match the glob,
+// named relative to the mount's bucket prefix. Folder placeholders are
+// left out.
+func inspectList(ctx context.Context, m *mount, prefix, match string) ([]object, error) {
+	if match != "" {
+		if _, err := path.Match(match, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", match, err)
+		}
+	}
+
+	bp := m.bucketKey(prefix)
+	files, err := m.p.List(ctx, bp, "", "", 1000, &storage.Query{Prefix: bp})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s failed: %v", bp, err)
+	}
+
+	n := 0
+	for _, f := range files {
+		rel := m.relativeKey(f.Name)
+		if rel == "" || strings.HasSuffix(rel, "/") || !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		if match != "" {
+			name := path.Base(rel)
+			if strings.Contains(match, "/") {
+				name = rel
+			}
+			if ok, _ := path.Match(match, name); !ok {
+				continue
+			}
+		}
+		f.Name = rel
+		files[n] = f
+		n++
+	}
+	return files[:n], nil
+}
+
+// writeRows writes the columns of the rows as an aligned table with human
+// readable sizes, as CSV, or as a JSON array of the whole rows.
+func writeRows(w io.Writer, format string, rows []inspectRow, columns ...string) error {
+	cell := func(r inspectRow, column string, human bool) string {
+		switch column {
+		case "name":
+			return r.Name
+		case "size":
+			if human {
+				return units.HumanSize(float64(r.Size))
+			}
+			return strconv.FormatInt(r.Size, 10)
+		case "objects":
+			return strconv.Itoa(r.Objects)
+		case "type":
+			return r.ContentType
+		case "modified":
+			if r.Modified.IsZero() {
+				return ""
+			}
+			return r.Modified.UTC().Format(time.RFC3339)
+		}
+		return ""
+	}
+
+	switch format {
+	case "json":
+		if rows == nil {
+			rows = []inspectRow{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(columns)
+		for _, r := range rows {
+			record := make([]string, len(columns))
+			for i, c := range columns {
+				record[i] = cell(r, c, false)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, r := range rows {
+			record := make([]string, len(columns))
+			for i, c := range columns {
+				record[i] = cell(r, c, true)
+			}
+			fmt.Fprintln(tw, strings.Join(record, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestInspectList(t *testing.T) {
+	m := &mount{name: "gifs", p: newFakeCloud("gifs", map[string]string{
+		"gifs/top.gif":             "top",
+		"gifs/reactions/":          "",
+		"gifs/reactions/dance.gif": "dance",
+		"gifs/reactions/notes.txt": "notes",
+		"gifs-private/secret.gif":  "secret",
+	})}
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		prefix string
+		match  string
+		want   string
+	}{
+		{"", "", "reactions/dance.gif,reactions/notes.txt,top.gif"},
+		{"reactions/", "", "reactions/dance.gif,reactions/notes.txt"},
+		{"", "*.gif", "reactions/dance.gif,top.gif"},
+		{"", "reactions/*.txt", "reactions/notes.txt"},
+		{"private/", "", ""},
+	} {
+		files, err := inspectList(ctx, m, c.prefix, c.match)
+		if err != nil {
+			t.Errorf("prefix %q, match %q: %v", c.prefix, c.match, err)
+			continue
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		if got := strings.Join(names, ","); got != c.want {
+			t.Errorf("prefix %q, match %q: got %s, want %s", c.prefix, c.match, got, c.want)
+		}
+	}
+}
+
+func TestInspectListPages(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("gifs/%04d.gif", i))
+	}
+	keys = append(keys, "gifs/reactions/dance.gif")
+	srv := newS3ListServer(keys)
+	defer srv.Close()
+
+	client := s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Name: "test", S3Endpoint: srv.URL})
+	m := &mount{name: "gifs", p: &s3Provider{bucket: "gifs", prefix: "gifs", client: client, b: client.Bucket("gifs")}}
+	ctx := context.Background()
+
+	// the totals of ls and du cover every page of the listing
+	for _, c := range []struct {
+		prefix string
+		match  string
+		want   int
+	}{
+		{"", "", 2501},
+		{"", "24*.gif", 100},
+		{"reactions/", "", 1},
+	} {
+		files, err := inspectList(ctx, m, c.prefix, c.match)
+		if err != nil {
+			t.Fatalf("prefix %q, match %q: %v", c.prefix, c.match, err)
+		}
+		if len(files) != c.want {
+			t.Errorf("prefix %q, match %q: got %d objects, want %d", c.prefix, c.match, len(files), c.want)
+		}
+	}
+}
+
+func TestStatCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "reactions"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "reactions", "dance.gif"), []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configMu.Lock()
+	mountConfigs = []mountConfig{{Name: "gifs", Path: "/gifs", Provider: "file", Bucket: "file://" + dir, Interval: time.Minute}}
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		mountConfigs = nil
+		configMu.Unlock()
+	}()
+
+	// capture the output
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	cmd := &statCommand{inspectFlags{format: "csv"}}
+	runErr := cmd.Run(context.Background(), []string{"/reactions/dance.gif"})
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+
+	if runErr != nil {
+		t.Fatal(runErr)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "/reactions/dance.gif,6,image/gif,") {
+		t.Errorf("got output:\n%s", out)
+	}
+
+	if err := cmd.Run(context.Background(), []string{"missing.gif"}); err == nil {
+		t.Error("stat of a missing object: expected an error")
+	}
+}
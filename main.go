@@ -2,17 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"syscall"
-	"text/template"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -20,22 +22,70 @@ import (
 	"github.com/genuinetools/pkg/cli"
 	"github.com/jessfraz/s3server/version"
 	"github.com/sirupsen/logrus"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/trace"
 )
 
 var (
-	provider string
-	bucket   string
-	interval time.Duration
+	configFile string
+
+	provider  string
+	bucket    string
+	interval  time.Duration
+	templates string
 
 	s3AccessKey string
 	s3SecretKey string
 	s3Region    string
 
+	address  string
 	port     string
 	certFile string
 	keyFile  string
+	certDir  string
+
+	publicURL string
+
+	tlsMinVersion string
+	tlsCiphers    string
+	httpRedirect  string
+	clientCA      string
+
+	readyIntervals int
+
+	otlpEndpoint string
+	traceSample  float64
+
+	accessLog           string
+	accessLogFormat     string
+	accessLogMaxSize    int
+	accessLogMaxBackups int
+	trustedProxies      string
+	auditLogPath        string
+
+	uploadACL     string
+	uploadPublic  bool
+	maxUploadSize int
+	uploadDir     string
+	uploadExpiry  time.Duration
+
+	maxArchiveSize int
+
+	webdavPath     string
+	webdavWritable bool
+
+	s3GatewayPath string
 
-	updating bool
+	describeObjects bool
+
+	thumbnails    bool
+	thumbnailDir  string
+	thumbnailSize int
+
+	publish             bool
+	publishBucket       string
+	publishCacheControl string
+	publishACL          string
 
 	debug bool
 )
@@ -50,40 +100,104 @@ func main() {
 	p.GitCommit = version.GITCOMMIT
 	p.Version = version.VERSION
 
+	// Build the list of available commands.
+	p.Commands = []cli.Command{
+		&duCommand{},
+		&generateCommand{},
+		&lsCommand{},
+		&statCommand{},
+		&syncCommand{},
+	}
+
 	// Setup the global flags.
 	p.FlagSet = flag.NewFlagSet("global", flag.ExitOnError)
-	p.FlagSet.StringVar(&provider, "provider", "s3", "cloud provider (ex. s3, gcs)")
+	p.FlagSet.StringVar(&configFile, "config", "", "path to a YAML config file, reloaded on change or SIGHUP")
+
+	p.FlagSet.StringVar(&provider, "provider", "s3", "cloud provider (ex. s3, gcs, file)")
 	p.FlagSet.StringVar(&bucket, "bucket", "", "bucket path from which to serve files")
 	p.FlagSet.DurationVar(&interval, "interval", 5*time.Minute, "interval to generate new index.html's at")
+	p.FlagSet.StringVar(&templates, "templates", "", "path to the templates directory, defaults to the one next to static")
 
 	p.FlagSet.StringVar(&s3AccessKey, "s3key", "", "s3 access key")
 	p.FlagSet.StringVar(&s3SecretKey, "s3secret", "", "s3 access secret")
 	p.FlagSet.StringVar(&s3Region, "s3region", "us-west-2", "aws region for the bucket")
 
+	p.FlagSet.StringVar(&address, "address", "", "address for server to listen on")
 	p.FlagSet.StringVar(&port, "p", "8080", "port for server to run on")
+	p.FlagSet.StringVar(&publicURL, "public-url", "", "URL the server is reached at, for absolute links on pages (ex. https://gifs.example.com)")
 
 	p.FlagSet.StringVar(&certFile, "cert", "", "path to ssl certificate")
 	p.FlagSet.StringVar(&keyFile, "key", "", "path to ssl key")
+	p.FlagSet.StringVar(&certDir, "cert-dir", "", "directory of <name>.crt and <name>.key pairs, selected by SNI")
+	p.FlagSet.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "minimum TLS version (ex. 1.0, 1.1, 1.2, 1.3)")
+	p.FlagSet.StringVar(&tlsCiphers, "tls-ciphers", "intermediate", "cipher suite policy for TLS 1.2 and earlier (ex. modern, intermediate, default)")
+	p.FlagSet.StringVar(&httpRedirect, "http-redirect", "", "address for a plain HTTP listener that redirects to https (ex. :80)")
+	p.FlagSet.StringVar(&clientCA, "client-ca", "", "path to a CA bundle, if set client certificates signed by it are required")
+
+	p.FlagSet.IntVar(&readyIntervals, "ready-intervals", 3, "number of intervals without a successful index before /readyz fails")
+
+	p.FlagSet.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector endpoint to export traces to (ex. http://localhost:4318)")
+	p.FlagSet.Float64Var(&traceSample, "trace-sample", 1, "fraction of requests and index runs to trace")
+
+	p.FlagSet.StringVar(&accessLog, "access-log", "", "where to write access logs, either a file path or `-` for stdout")
+	p.FlagSet.StringVar(&accessLogFormat, "access-log-format", "json", "access log format (ex. json, combined)")
+	p.FlagSet.IntVar(&accessLogMaxSize, "access-log-max-size", 100, "size in megabytes at which the access log file is rotated")
+	p.FlagSet.IntVar(&accessLogMaxBackups, "access-log-max-backups", 5, "number of rotated access log files to keep")
+	p.FlagSet.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated IPs or CIDRs of proxies trusted to set X-Forwarded-For")
+	p.FlagSet.StringVar(&auditLogPath, "audit-log", "", "where to write the audit log of uploads and changes, either a file path or `-` for stdout, defaults to the server log")
+
+	p.FlagSet.StringVar(&uploadACL, "upload-acl", "private", "canned ACL for objects uploaded to s3 (ex. private, public-read)")
+	p.FlagSet.BoolVar(&uploadPublic, "upload-public", false, "allow an upload-acl that makes uploads public when authz rules are set")
+	p.FlagSet.IntVar(&maxUploadSize, "max-upload-size", 5120, "maximum upload size in megabytes, 0 for no limit")
+	p.FlagSet.StringVar(&uploadDir, "upload-dir", filepath.Join(os.TempDir(), "s3server-uploads"), "directory to keep the state of resumable uploads in")
+	p.FlagSet.DurationVar(&uploadExpiry, "upload-expiry", 24*time.Hour, "how long a resumable upload can sit idle before it is aborted")
+
+	p.FlagSet.IntVar(&maxArchiveSize, "max-archive-size", 2048, "maximum total size in megabytes of the objects in a downloaded archive, 0 for no limit")
+
+	p.FlagSet.StringVar(&webdavPath, "webdav", "", "path to serve the mounts over WebDAV at (ex. /dav)")
+	p.FlagSet.BoolVar(&webdavWritable, "webdav-writable", false, "allow authenticated WebDAV clients to change the bucket")
+
+	p.FlagSet.StringVar(&s3GatewayPath, "s3-gateway", "", "path to serve a read-only S3 API for the mounts at (ex. /s3)")
+
+	p.FlagSet.BoolVar(&describeObjects, "describe", false, "read titles, descriptions and tags from object metadata, sidecar files and manifests")
+
+	p.FlagSet.BoolVar(&thumbnails, "thumbnails", false, "make thumbnails of gif, png and jpeg objects while indexing, for the gallery view")
+	p.FlagSet.StringVar(&thumbnailDir, "thumbnail-dir", filepath.Join(os.TempDir(), "s3server-thumbnails"), "directory to cache thumbnails in")
+	p.FlagSet.IntVar(&thumbnailSize, "thumbnail-size", 200, "width and height in pixels that thumbnails fit in")
+
+	p.FlagSet.BoolVar(&publish, "publish", false, "upload the rendered index and assets to the bucket after every refresh")
+	p.FlagSet.StringVar(&publishBucket, "publish-bucket", "", "bucket path to publish the index and assets to instead of the root of each mount's bucket")
+	p.FlagSet.StringVar(&publishCacheControl, "publish-cache-control", "public, max-age=60", "Cache-Control of published index pages")
+	p.FlagSet.StringVar(&publishACL, "publish-acl", "public-read", "canned ACL for the index and assets published to s3 or gcs (ex. private, public-read)")
 
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
 
 	// Set the before function.
 	p.Before = func(ctx context.Context) error {
+		// Apply the config file and environment.
+		if err := loadConfig(p.FlagSet); err != nil {
+			return err
+		}
+
 		// Set the log level.
 		if debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
 
-		if provider != "s3" && provider != "gcs" {
-			return fmt.Errorf("%s is not a valid provider, try `s3` or `gcs`", provider)
-		}
-
 		return nil
 	}
 
 	// Set the main program action.
 	p.Action = func(ctx context.Context, args []string) error {
-		ticker := time.NewTicker(interval)
+		fs := p.FlagSet
+
+		// set up tracing
+		var exporter *otlpExporter
+		if otlpEndpoint != "" {
+			exporter = newOTLPExporter(otlpEndpoint, "s3server")
+			trace.RegisterExporter(exporter)
+		}
+		applyRuntimeConfig(exporter)
 
 		// On ^C, or SIGTERM handle exit.
 		c := make(chan os.Signal, 1)
@@ -91,18 +205,14 @@ func main() {
 		signal.Notify(c, syscall.SIGTERM)
 		go func() {
 			for sig := range c {
-				ticker.Stop()
+				if exporter != nil {
+					exporter.Flush()
+				}
 				logrus.Infof("Received %s, exiting.", sig.String())
 				os.Exit(0)
 			}
 		}()
 
-		// create a new provider
-		p, err := newProvider(provider, bucket, s3Region, s3AccessKey, s3SecretKey)
-		if err != nil {
-			logrus.Fatalf("Creating new provider failed: %v", err)
-		}
-
 		// get the path to the static directory
 		wd, err := os.Getwd()
 		if err != nil {
@@ -110,41 +220,201 @@ func main() {
 		}
 		staticDir := filepath.Join(wd, "static")
 
-		// create the initial index
-		if err := createStaticIndex(p, staticDir); err != nil {
-			logrus.Fatalf("Creating initial static index failed: %v", err)
+		// create the mounts and their initial indexes
+		if err := startMounts(ctx, staticDir); err != nil {
+			logrus.Fatalf("Creating mounts failed: %v", err)
 		}
 
+		// load the resumable uploads left from before a restart and abort
+		// the ones that sit idle for too long
+		tusUploads, err = newTusStore(uploadDir)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tusUploads.expire(ctx, uploadExpiry)
+		go tusUploads.expireEvery(ctx, 10*time.Minute)
+
+		// On SIGHUP, or when the config file changes, reload the config
+		// and certificates.
+		reload := make(chan string, 1)
+		certReload := make(chan struct{}, 1)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		go func() {
-			// create more indexes every X minutes based off interval
-			for range ticker.C {
-				if !updating {
-					if err := createStaticIndex(p, staticDir); err != nil {
-						logrus.Warnf("creating static index failed: %v", err)
-						updating = false
-					}
-				}
+			for range hup {
+				reload <- "SIGHUP"
 			}
 		}()
+		if configFile != "" {
+			go watchConfig(configFile, 2*time.Second, reload)
+		}
 
 		// create mux server
 		mux := http.NewServeMux()
 
-		// static files handler
+		// health, readiness and status handlers
+		mux.Handle("/healthz", instrument("healthz", http.HandlerFunc(healthzHandler)))
+		mux.Handle("/readyz", instrument("readyz", http.HandlerFunc(readyzHandler)))
+		mux.Handle("/-/status", instrument("status", http.HandlerFunc(statusHandler)))
+
+		// prometheus metrics handler
+		mux.HandleFunc("/metrics", metricsHandler)
+
+		// static files handler, routed by host
 		staticHandler := http.FileServer(http.Dir(staticDir))
-		mux.Handle("/", staticHandler)
+		mux.Handle("/-/objects/", instrument("objects", http.HandlerFunc(objectHandler)))
+		mux.Handle("/-/thumbnails/", instrument("thumbnails", http.HandlerFunc(thumbnailHandler)))
+
+		// folder downloads
+		mux.Handle("/archive/", instrument("archive", http.HandlerFunc(archiveHandler)))
+
+		// object pages
+		mux.Handle("/view/", instrument("view", http.HandlerFunc(viewHandler)))
+
+		// WebDAV frontend
+		if webdavPath != "" {
+			prefix := "/" + strings.Trim(webdavPath, "/")
+			mux.Handle(prefix+"/", instrument("webdav", davHandler(prefix)))
+		}
+
+		// S3 API gateway
+		if s3GatewayPath != "" {
+			prefix := "/" + strings.Trim(s3GatewayPath, "/")
+			mux.Handle(prefix+"/", instrument("s3_gateway", s3GatewayHandler(prefix)))
+		}
+
+		// object API
+		mux.Handle("/api/v1/objects/", instrument("api_objects", http.HandlerFunc(objectsAPIHandler)))
+		mux.Handle("/api/v1/delete", instrument("api_delete", http.HandlerFunc(deleteHandler)))
+		mux.Handle("/api/v1/copy", instrument("api_copy", copyHandler(false)))
+		mux.Handle("/api/v1/move", instrument("api_move", copyHandler(true)))
+		mux.Handle("/api/v1/uploads/", instrument("api_uploads", http.HandlerFunc(tusHandler)))
+		mux.Handle("/api/v1/search", instrument("api_search", http.HandlerFunc(searchHandler)))
+		mux.Handle("/", instrument("static", hostHandler(indexHandler(staticHandler))))
+
+		// require authentication, if configured
+		var handler http.Handler = authHandler(mux)
+
+		// require client certificates
+		if clientCA != "" {
+			handler = clientCertHandler(handler)
+		}
+
+		// set up access logging
+		if accessLog != "" {
+			var w io.Writer = os.Stdout
+			if accessLog != "-" {
+				w, err = newRotatingFile(accessLog, int64(accessLogMaxSize)*1024*1024, accessLogMaxBackups)
+				if err != nil {
+					logrus.Fatalf("Opening access log %s failed: %v", accessLog, err)
+				}
+			}
+			l, err := newAccessLogger(w, accessLogFormat, trustedProxies)
+			if err != nil {
+				logrus.Fatalf("Creating access logger failed: %v", err)
+			}
+			handler = l.handler(handler)
+		}
+
+		// set up audit logging
+		if auditLogPath != "" {
+			var w io.Writer = os.Stdout
+			if auditLogPath != "-" {
+				w, err = newRotatingFile(auditLogPath, int64(accessLogMaxSize)*1024*1024, accessLogMaxBackups)
+				if err != nil {
+					logrus.Fatalf("Opening audit log %s failed: %v", auditLogPath, err)
+				}
+			}
+			auditLog, err = newAuditLogger(w, trustedProxies)
+			if err != nil {
+				logrus.Fatalf("Creating audit logger failed: %v", err)
+			}
+		}
 
 		// set up the server
 		server := &http.Server{
-			Addr:    ":" + port,
-			Handler: mux,
+			Addr: address + ":" + port,
+			Handler: &ochttp.Handler{
+				Handler:          handler,
+				IsPublicEndpoint: true,
+				FormatSpanName: func(r *http.Request) string {
+					return r.Method + " " + r.URL.Path
+				},
+			},
+		}
+
+		// set up tls
+		certs, err := newCertStore(certFile, keyFile, certDir)
+		if err != nil {
+			logrus.Fatalf("Loading certificates failed: %v", err)
+		}
+		if certs == nil && clientCA != "" {
+			logrus.Fatal("Requiring client certificates needs a server certificate, set -cert and -key or -cert-dir")
+		}
+		if certs != nil {
+			go certs.watch(10 * time.Second)
+			go func() {
+				for range certReload {
+					certs.reload()
+				}
+			}()
+			server.TLSConfig = newTLSConfig(certs)
+			if clientCA != "" {
+				pool, err := loadClientCAs(clientCA)
+				if err != nil {
+					logrus.Fatalf("Loading client CAs failed: %v", err)
+				}
+				// Certificates are verified during the handshake, but only
+				// required by clientCertHandler so health checks still work.
+				server.TLSConfig.ClientCAs = pool
+				server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 		}
-		logrus.Infof("Starting server on port %q", port)
-		if certFile != "" && keyFile != "" {
-			logrus.Fatal(server.ListenAndServeTLS(certFile, keyFile))
-		} else {
+		listenPort, redirectAddr := port, httpRedirect
+
+		// Only start reloading once the listener settings have been read,
+		// reloads change the flag variables.
+		go func() {
+			for reason := range reload {
+				logrus.Infof("Reloading config on %s", reason)
+				oldMounts, oldListener := mountSettings(), listenerSettings()
+				if err := loadConfig(fs); err != nil {
+					logrus.Warnf("reloading config failed, keeping the previous config: %v", err)
+					continue
+				}
+				applyRuntimeConfig(exporter)
+
+				if listenerSettings() != oldListener {
+					logrus.Warn("listen address, TLS policy and access log changes take effect on restart")
+				}
+
+				select {
+				case certReload <- struct{}{}:
+				default:
+				}
+
+				if mountSettings() != oldMounts {
+					if err := startMounts(ctx, staticDir); err != nil {
+						logrus.Warnf("reloading mounts failed, keeping the previous mounts: %v", err)
+					}
+				}
+			}
+		}()
+
+		if certs == nil {
+			logrus.Infof("Starting server on port %q", listenPort)
 			logrus.Fatal(server.ListenAndServe())
 		}
+
+		if redirectAddr != "" {
+			go func() {
+				logrus.Infof("Starting https redirect server on %q", redirectAddr)
+				logrus.Fatal(http.ListenAndServe(redirectAddr, redirectHandler(listenPort)))
+			}()
+		}
+
+		logrus.Infof("Starting server on port %q", listenPort)
+		logrus.Fatal(server.ListenAndServeTLS("", ""))
 		return nil
 	}
 
@@ -153,19 +423,67 @@ func main() {
 }
 
 type object struct {
-	Name    string
-	BaseURL string
-	Size    int64
+	Name        string
+	BaseURL     string
+	Size        int64
+	ContentType string
+	Modified    time.Time
+	// ETag is the hex MD5 of the contents if the listing has it, or for
+	// s3 multipart uploads an opaque value with a dash.
+	ETag string
+	// Metadata is the user-defined metadata, if the listing has it.
+	Metadata map[string]string
+
+	// Title, Description and Tags describe the object, from its metadata
+	// or sidecar files.
+	Title       string
+	Description string
+	Tags        []string
+
+	// Thumbnail is the name of the thumbnail of an image, if it has one.
+	Thumbnail string
 }
 
 type data struct {
 	SiteURL     string
 	LastUpdated string
+	Mount       string
+	Prefix      string
+	Writable    bool
+	Thumbnails  bool
+	Views       bool
 	Files       []object
 }
 
-func createStaticIndex(p cloud, staticDir string) error {
-	updating = true
+// createStaticIndex lists the files in the mount's bucket and renders them
+// into the mount's index.html.
+func (m *mount) createStaticIndex(ctx context.Context) (err error) {
+	p := m.p
+
+	ctx, span := trace.StartSpan(ctx, "createStaticIndex")
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("mount", m.name))
+
+	var files []object
+	start := m.status.start()
+	defer func() {
+		setSpanError(span, err)
+		span.AddAttributes(trace.Int64Attribute("objects", int64(len(files))))
+		m.status.finish(start, len(files), err)
+		indexDuration.since(start, m.name)
+		if err != nil {
+			indexRuns.inc(m.name, "failure")
+			return
+		}
+		indexRuns.inc(m.name, "success")
+
+		var size int64
+		for _, f := range files {
+			size += f.Size
+		}
+		indexObjects.set(float64(len(files)), m.name, m.provider)
+		indexBytes.set(float64(size), m.name, m.provider)
+	}()
 
 	// get the files
 	max := 2000
@@ -173,26 +491,43 @@ func createStaticIndex(p cloud, staticDir string) error {
 		Prefix: p.Prefix(),
 	}
 
-	logrus.Infof("fetching files from %s", p.BaseURL())
-	files, err := p.List(p.Prefix(), p.Prefix(), "", max, q)
+	logrus.Infof("fetching files for mount %s from %s", m.name, p.BaseURL())
+	files, err = p.List(ctx, p.Prefix(), p.Prefix(), "", max, q)
 	if err != nil {
 		return fmt.Errorf("listing all files in bucket failed: %v", err)
 	}
+	files = m.withoutPublished(files)
+	configMu.RLock()
+	describe, thumbs := describeObjects, thumbnails
+	configMu.RUnlock()
+	if describe {
+		files = m.describe(ctx, files)
+	}
+	if thumbs && !m.readOnly {
+		m.thumbnail(ctx, files)
+	}
 
-	// set up custom functions
-	funcMap := template.FuncMap{
-		"ext": func(name string) string {
-			return strings.TrimPrefix(filepath.Ext(name), ".")
-		},
-		"base": func(name string) string {
-			parts := strings.Split(name, "/")
-			return parts[len(parts)-1]
-		},
-		"size": func(s int64) string {
-			return units.HumanSize(float64(s))
-		},
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+	if err := m.writeIndex(ctx, files); err != nil {
+		return err
 	}
 
+	if m.publish != nil {
+		if err := m.publishSite(ctx); err != nil {
+			logrus.Warnf("publishing the index for mount %s failed: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+// writeIndex stores the listing of the mount and renders it to the static
+// index file. It must be called with indexMu held.
+func (m *mount) writeIndex(ctx context.Context, files []object) error {
+	// keep the listing around for the dynamic handlers
+	lastUpdated := time.Now().Local().Format(time.RFC1123)
+	m.setFiles(files, lastUpdated)
+
 	// create temporoary file to save template to
 	logrus.Info("creating temporary file for template")
 	f, err := ioutil.TempFile("", "s3server")
@@ -202,30 +537,108 @@ func createStaticIndex(p cloud, staticDir string) error {
 	defer f.Close()
 	defer os.Remove(f.Name())
 
-	// parse & execute the template
+	// parse & execute the template, with authz rules the index is rendered
+	// for each viewer and the static file only lists what anyone may read
 	logrus.Info("parsing and executing the template")
-	templateDir := filepath.Join(staticDir, "../templates")
-	lp := filepath.Join(templateDir, "layout.html")
+	d := m.data(files, lastUpdated, m.readOnly || len(currentAuthzRules()) > 0)
+	_, renderSpan := trace.StartSpan(ctx, "renderTemplate")
+	err = m.render(f, d)
+	renderSpan.End()
+	if err != nil {
+		return err
+	}
+	f.Close()
 
-	d := data{
+	logrus.Infof("renaming the temporary file %s to %s", f.Name(), m.index)
+	if _, err := moveFile(m.index, f.Name()); err != nil {
+		return fmt.Errorf("renaming result from %s to %s failed: %v", f.Name(), m.index, err)
+	}
+	return nil
+}
+
+// data returns the template data for a listing of the mount. Read-only
+// pages have no change forms and only list the objects anyone may read.
+func (m *mount) data(files []object, lastUpdated string, readOnly bool) data {
+	configMu.RLock()
+	writable := auth != nil && !readOnly
+	rules := authzRules
+	thumbs := thumbnails
+	configMu.RUnlock()
+
+	if readOnly {
+		files = m.publicObjects(rules, files)
+	}
+
+	prefix := m.p.Prefix()
+	if prefix == "/" {
+		prefix = ""
+	}
+
+	return data{
 		Files:       files,
-		LastUpdated: time.Now().Local().Format(time.RFC1123),
+		Mount:       m.name,
+		Prefix:      prefix,
+		Writable:    writable,
+		Thumbnails:  thumbs && !readOnly,
+		Views:       !readOnly,
+		LastUpdated: lastUpdated,
 	}
-	tmpl := template.Must(template.New("").Funcs(funcMap).ParseFiles(lp))
-	if err := tmpl.ExecuteTemplate(f, "layout", d); err != nil {
-		return fmt.Errorf("execute template failed: %v", err)
+}
+
+// publicObjects returns the objects anyone may read under the authz rules.
+func (m *mount) publicObjects(rules []authzRule, files []object) []object {
+	if len(rules) == 0 {
+		return files
+	}
+	public := make([]object, 0, len(files))
+	for _, f := range files {
+		if authzAllowed(rules, nil, m.name, f.Name) {
+			public = append(public, f)
+		}
+	}
+	return public
+}
+
+// render executes the mount's template with the given data.
+func (m *mount) render(w io.Writer, d data) error {
+	// set up custom functions
+	funcMap := template.FuncMap{
+		"ext": func(name string) string {
+			return strings.TrimPrefix(filepath.Ext(name), ".")
+		},
+		"base": func(name string) string {
+			parts := strings.Split(name, "/")
+			return parts[len(parts)-1]
+		},
+		"size": func(s int64) string {
+			return units.HumanSize(float64(s))
+		},
+		"pathescape": escapeKeyPath,
+		// href links to an object on its provider's host, or relative to
+		// the server if it is proxied
+		"href": func(o object) string {
+			if strings.HasPrefix(o.BaseURL, "/") {
+				return o.BaseURL + "/" + escapeKeyPath(o.Name)
+			}
+			return "//" + o.BaseURL + "/" + escapeKeyPath(o.Name)
+		},
 	}
-	f.Close()
 
-	index := filepath.Join(staticDir, "index.html")
-	logrus.Infof("renaming the temporary file %s to %s", f.Name(), index)
-	if _, err := moveFile(index, f.Name()); err != nil {
-		return fmt.Errorf("renaming result from %s to %s failed: %v", f.Name(), index, err)
+	tmpl, err := template.New("").Funcs(funcMap).ParseFiles(m.template)
+	if err != nil {
+		return fmt.Errorf("parsing template %s failed: %v", m.template, err)
+	}
+	if err := tmpl.ExecuteTemplate(w, "layout", d); err != nil {
+		return fmt.Errorf("execute template failed: %v", err)
 	}
-	updating = false
 	return nil
 }
 
+// escapeKeyPath escapes an object key for use in a URL path.
+func escapeKeyPath(key string) string {
+	return strings.Replace(url.PathEscape(key), "%2F", "/", -1)
+}
+
 func moveFile(dst, src string) (int64, error) {
 	sf, err := os.Open(src)
 	if err != nil {
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderEscapesKeys(t *testing.T) {
+	evil := `"><script>alert(1)</script>.gif`
+	m := &mount{
+		name:     `gifs"><script>alert(2)</script>`,
+		template: "templates/layout.html",
+		p:        newFakeCloud(`x"><script>alert(3)</script>/`, nil),
+	}
+	files := []object{{
+		Name:        evil,
+		BaseURL:     "bucket.example.com",
+		Title:       "<script>alert(4)</script>",
+		Description: `"><script>alert(5)</script>`,
+		Tags:        []string{"<script>alert(6)</script>"},
+		Thumbnail:   "0123abcd",
+		Modified:    time.Now(),
+	}}
+	auth = &authState{}
+	thumbnails = true
+	defer func() { auth, thumbnails = nil, false }()
+
+	var b bytes.Buffer
+	if err := m.render(&b, m.data(files, "now", false)); err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+	if strings.Contains(page, "<script>alert") {
+		t.Errorf("the page has an unescaped key:\n%s", page)
+	}
+	if !strings.Contains(page, "%22%3E%3Cscript%3Ealert%281%29%3C/script%3E.gif") {
+		t.Errorf("the link to the object is not escaped as a path:\n%s", page)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// manifestName is the name of the files that describe the objects
+	// under their prefix, keyed by name relative to it.
+	manifestName = "_manifest.json"
+
+	// sidecarExt is the extension of the files that describe the object
+	// with the same name without it, like facepalm.gif.json.
+	sidecarExt = ".json"
+
+	// metadataParallel is how many objects are read at once for their
+	// metadata or descriptions.
+	metadataParallel = 8
+
+	// maxDescriptionSize is the largest sidecar or manifest that is read.
+	maxDescriptionSize = 1 << 20
+)
+
+// objectMeta describes an object, as read from its metadata, a sidecar
+// file or a manifest.
+type objectMeta struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// merge sets the title and description from o if they are set there, and
+// adds its tags.
+func (d *objectMeta) merge(o objectMeta) {
+	if o.Title != "" {
+		d.Title = o.Title
+	}
+	if o.Description != "" {
+		d.Description = o.Description
+	}
+	for _, t := range o.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		dup := false
+		for _, have := range d.Tags {
+			if strings.EqualFold(have, t) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			d.Tags = append(d.Tags, t)
+		}
+	}
+}
+
+// metaFromMetadata reads the title, description and comma separated tags
+// from user-defined metadata.
+func metaFromMetadata(md map[string]string) objectMeta {
+	d := objectMeta{Title: md["title"], Description: md["description"]}
+	if tags := md["tags"]; tags != "" {
+		d.Tags = strings.Split(tags, ",")
+	}
+	return d
+}
+
+// cachedMeta is what was read for an object at a version of it, so that it
+// is only read again once the object changes.
+type cachedMeta struct {
+	version  string
+	metadata map[string]string
+	sidecar  *objectMeta
+	manifest map[string]objectMeta
+}
+
+// objectVersion identifies the contents of an object.
+func objectVersion(o object) string {
+	if o.ETag != "" {
+		return o.ETag
+	}
+	return strconv.FormatInt(o.Size, 10) + "@" + o.Modified.String()
+}
+
+// withoutDescriptions returns files without the manifests and sidecar
+// files that describe the others.
+func withoutDescriptions(files []object) []object {
+	names := map[string]bool{}
+	for _, f := range files {
+		names[f.Name] = true
+	}
+	kept := make([]object, 0, len(files))
+	for _, f := range files {
+		if path.Base(f.Name) == manifestName || strings.HasSuffix(f.Name, sidecarExt) && names[strings.TrimSuffix(f.Name, sidecarExt)] {
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// describe sets the title, description and tags of the files from their
+// metadata, the manifests above them and their sidecar files, in that
+// order, and returns them without the sidecars and manifests.
+func (m *mount) describe(ctx context.Context, files []object) []object {
+	names := map[string]bool{}
+	for _, f := range files {
+		names[f.Name] = true
+	}
+
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	cache := map[string]cachedMeta{}
+
+	// read what is not cached from the last listing
+	var (
+		mu      sync.Mutex
+		read    []object
+		objects []object
+	)
+	for _, f := range files {
+		isSidecar := strings.HasSuffix(f.Name, sidecarExt) && names[strings.TrimSuffix(f.Name, sidecarExt)]
+		if c, ok := m.metaCache[f.Name]; ok && c.version == objectVersion(f) {
+			cache[f.Name] = c
+			if path.Base(f.Name) != manifestName && !isSidecar {
+				objects = append(objects, f)
+			}
+			continue
+		}
+		switch {
+		case path.Base(f.Name) == manifestName || isSidecar:
+			read = append(read, f)
+		default:
+			objects = append(objects, f)
+			if f.Metadata == nil {
+				read = append(read, f)
+			}
+		}
+	}
+
+	forEachParallel(len(read), metadataParallel, func(i int) {
+		f := read[i]
+		c := cachedMeta{version: objectVersion(f)}
+		var err error
+		switch {
+		case path.Base(f.Name) == manifestName:
+			err = m.readDescription(ctx, f.Name, &c.manifest)
+		case strings.HasSuffix(f.Name, sidecarExt) && names[strings.TrimSuffix(f.Name, sidecarExt)]:
+			c.sidecar = &objectMeta{}
+			err = m.readDescription(ctx, f.Name, c.sidecar)
+		default:
+			c.metadata, err = m.p.Metadata(ctx, f.Name)
+		}
+		if err != nil {
+			logrus.Warnf("reading the description of %s in mount %s failed: %v", f.Name, m.name, err)
+			return
+		}
+		mu.Lock()
+		cache[f.Name] = c
+		mu.Unlock()
+	})
+	m.metaCache = cache
+
+	for i, f := range objects {
+		var d objectMeta
+		md := f.Metadata
+		if md == nil {
+			md = cache[f.Name].metadata
+		}
+		d.merge(metaFromMetadata(md))
+
+		// manifests from the outermost prefix in
+		parts := strings.Split(f.Name, "/")
+		for j := 0; j < len(parts); j++ {
+			dir := strings.Join(parts[:j], "/")
+			if dir != "" {
+				dir += "/"
+			}
+			if c, ok := cache[dir+manifestName]; ok {
+				d.merge(c.manifest[strings.Join(parts[j:], "/")])
+			}
+		}
+
+		if c, ok := cache[f.Name+sidecarExt]; ok && c.sidecar != nil {
+			d.merge(*c.sidecar)
+		}
+		objects[i].Title, objects[i].Description, objects[i].Tags = d.Title, d.Description, d.Tags
+	}
+	return objects
+}
+
+// readDescription reads a sidecar or manifest object as JSON into v.
+func (m *mount) readDescription(ctx context.Context, key string, v interface{}) error {
+	body, _, err := m.p.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxDescriptionSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxDescriptionSize {
+		return fmt.Errorf("%s is larger than %d bytes", key, maxDescriptionSize)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("parsing %s failed: %v", key, err)
+	}
+	return nil
+}
+
+// forEachParallel calls fn for 0 to n-1, at most parallel at once.
+func forEachParallel(n, parallel int, fn func(i int)) {
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestObjectMetaMerge(t *testing.T) {
+	d := objectMeta{Title: "Dance", Tags: []string{"fun"}}
+	d.merge(objectMeta{Description: "A dance", Tags: []string{"Fun", " happy ", ""}})
+	d.merge(objectMeta{Title: "Dancing"})
+	want := objectMeta{Title: "Dancing", Description: "A dance", Tags: []string{"fun", "happy"}}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{
+		"_manifest.json":           `{"reactions/dance.gif": {"title": "Outer", "tags": ["fun"]}, "wave.gif": {"description": "Hello"}}`,
+		"reactions/_manifest.json": `{"dance.gif": {"title": "Inner", "description": "From the manifest", "tags": ["Fun", "happy"]}}`,
+		"reactions/dance.gif":      "GIF89a",
+		"reactions/dance.gif.json": `{"title": "Dance"}`,
+		"wave.gif":                 "GIF89a",
+		"notes.json":               `{"title": "Not a sidecar"}`,
+		"broken/_manifest.json":    `{"shrug.gif": `,
+		"broken/shrug.gif":         "GIF89a",
+	})
+	p.metadata = map[string]map[string]string{
+		"reactions/dance.gif": {"title": "From metadata", "tags": "party"},
+		"wave.gif":            {"title": "Wave", "tags": "hi, ,bye"},
+	}
+	m := &mount{name: "gifs", p: p}
+	ctx := context.Background()
+
+	files, err := p.List(ctx, "", "", "", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []object{
+		{Name: "broken/shrug.gif"},
+		{Name: "notes.json"},
+		{Name: "reactions/dance.gif", Title: "Dance", Description: "From the manifest", Tags: []string{"party", "fun", "happy"}},
+		{Name: "wave.gif", Title: "Wave", Description: "Hello", Tags: []string{"hi", "bye"}},
+	}
+	check := func(step string) {
+		got := m.describe(ctx, append([]object(nil), files...))
+		if len(got) != len(want) {
+			t.Fatalf("%s: got %d objects, want %d: %+v", step, len(got), len(want), got)
+		}
+		for i, o := range got {
+			w := want[i]
+			if o.Name != w.Name || o.Title != w.Title || o.Description != w.Description || !reflect.DeepEqual(o.Tags, w.Tags) {
+				t.Errorf("%s: got %s %q %q %q, want %s %q %q %q", step, o.Name, o.Title, o.Description, o.Tags, w.Name, w.Title, w.Description, w.Tags)
+			}
+		}
+	}
+
+	check("first listing")
+	opened, reads := p.opened, p.metadataReads
+	if reads != 4 {
+		t.Errorf("read the metadata of %d objects, want 4", reads)
+	}
+
+	// unchanged objects are not read again, only the manifest that failed
+	check("unchanged listing")
+	if broken := int64(len(p.objects["broken/_manifest.json"])); p.opened-opened != broken || p.metadataReads != reads {
+		t.Errorf("unchanged listing: read %d bytes and %d metadata again, want %d bytes", p.opened-opened, p.metadataReads-reads, broken)
+	}
+
+	// a changed sidecar is read again
+	p.objects["reactions/dance.gif.json"] = []byte(`{"title": "Dancing"}`)
+	files, err = p.List(ctx, "", "", "", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[2].Title = "Dancing"
+	check("changed sidecar")
+	if p.metadataReads != reads {
+		t.Errorf("changed sidecar: read %d metadata again", p.metadataReads-reads)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBuckets are the histogram buckets, in seconds, used for latencies.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	httpRequests = newCounterVec("s3server_http_requests_total",
+		"Total number of HTTP requests by handler and status code.", "handler", "code")
+	httpDuration = newHistogramVec("s3server_http_request_duration_seconds",
+		"HTTP request latencies in seconds by handler.", defaultBuckets, "handler")
+
+	indexRuns = newCounterVec("s3server_index_runs_total",
+		"Total number of index runs by mount and outcome.", "mount", "outcome")
+	indexDuration = newHistogramVec("s3server_index_duration_seconds",
+		"Duration of index runs in seconds by mount.", defaultBuckets, "mount")
+	indexObjects = newGaugeVec("s3server_index_objects",
+		"Number of objects in the last successful index by mount and provider.", "mount", "provider")
+	indexBytes = newGaugeVec("s3server_index_bytes",
+		"Total size in bytes of the objects in the last successful index by mount and provider.", "mount", "provider")
+
+	providerCalls = newCounterVec("s3server_provider_calls_total",
+		"Total number of provider API calls by provider and operation.", "provider", "operation")
+	providerErrors = newCounterVec("s3server_provider_errors_total",
+		"Total number of failed provider API calls by provider and operation.", "provider", "operation")
+	providerDuration = newHistogramVec("s3server_provider_call_duration_seconds",
+		"Provider API call latencies in seconds by provider and operation.", defaultBuckets, "provider", "operation")
+
+	cacheLookups = newCounterVec("s3server_cache_lookups_total",
+		"Total number of cache lookups by cache and result, hit or miss.", "cache", "result")
+)
+
+// collectors holds every metric in the order they are exposed.
+var collectors = []collector{
+	httpRequests,
+	httpDuration,
+	indexRuns,
+	indexDuration,
+	indexObjects,
+	indexBytes,
+	providerCalls,
+	providerErrors,
+	providerDuration,
+	cacheLookups,
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// metricVec holds the shared name, help and label names of a metric.
+type metricVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+}
+
+// key joins label values into a map key.
+func (m *metricVec) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats label values in the exposition format, appending
+// any extra pairs given.
+func (m *metricVec) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(m.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, m.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes the characters the exposition format escapes in
+// label values. Go quoting also escapes other characters, which Prometheus
+// does not read back.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the exposition format.
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+type counterVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		metricVec: metricVec{name: name, help: help, labels: labels},
+		values:    map[string]float64{},
+	}
+}
+
+// inc increments the counter for the given label values.
+func (c *counterVec) inc(values ...string) {
+	k := c.key(values)
+	c.mu.Lock()
+	c.values[k]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(k), formatFloat(c.values[k]))
+	}
+}
+
+type gaugeVec struct {
+	counterVec
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{*newCounterVec(name, help, labels...)}
+}
+
+// set sets the gauge for the given label values.
+func (g *gaugeVec) set(v float64, values ...string) {
+	k := g.key(values)
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(k), formatFloat(g.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		metricVec: metricVec{name: name, help: help, labels: labels},
+		buckets:   buckets,
+		values:    map[string]*histogram{},
+	}
+}
+
+// observe records a value for the given label values.
+func (h *histogramVec) observe(v float64, values ...string) {
+	k := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// since records the time elapsed since start for the given label values.
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", formatFloat(b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(k), hist.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// observeProviderCall records a provider API call that began at start.
+func observeProviderCall(provider, operation string, start time.Time, err error) {
+	providerCalls.inc(provider, operation)
+	providerDuration.since(start, provider, operation)
+	if err != nil {
+		providerErrors.inc(provider, operation)
+	}
+}
+
+// observeCache counts a lookup in one of the caches.
+func observeCache(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.inc(cache, result)
+}
+
+// metricsHandler writes all metrics in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code
+// and number of bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// instrument wraps a handler to record request counts and latencies
+// under the given handler name.
+func instrument(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.inc(name, strconv.Itoa(rec.status))
+		httpDuration.since(start, name)
+	})
+}
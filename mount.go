@@ -0,0 +1,544 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mountConfig is a mount entry in the config file.
+type mountConfig struct {
+	Name     string        `yaml:"name"`
+	Path     string        `yaml:"path"`
+	Hosts    []string      `yaml:"hosts"`
+	Provider string        `yaml:"provider"`
+	Bucket   string        `yaml:"bucket"`
+	Interval time.Duration `yaml:"interval"`
+	Template string        `yaml:"template"`
+	S3       struct {
+		Key    string `yaml:"key"`
+		Secret string `yaml:"secret"`
+		Region string `yaml:"region"`
+	} `yaml:"s3"`
+}
+
+// reservedPaths are the top level paths that a mount cannot be served
+// under.
+var reservedPaths = []string{"/css/", "/js/", "/icons/", "/healthz/", "/readyz/", "/metrics/", "/-/", "/archive/", "/view/", "/api/", "/auth/"}
+
+// servedPaths returns the reserved paths and the configured WebDAV and S3
+// gateway paths. It must be called with configMu held.
+func servedPaths() []string {
+	paths := reservedPaths
+	for _, p := range []string{webdavPath, s3GatewayPath} {
+		if p != "" {
+			paths = append(paths[:len(paths):len(paths)], "/"+strings.Trim(p, "/")+"/")
+		}
+	}
+	return paths
+}
+
+// mount is a bucket that is indexed on its own interval and served under
+// its own path.
+type mount struct {
+	name     string
+	path     string
+	hosts    []string
+	provider string
+	interval time.Duration
+	template string
+	index    string
+
+	p      cloud
+	status *indexStatus
+	stop   chan struct{}
+
+	// readOnly renders the index as a read-only page, for sites that are
+	// served without s3server.
+	readOnly bool
+
+	// publish is where the rendered index and the assets are uploaded
+	// after every refresh, under publishPrefix, or nil. Published keys in
+	// the mount's own bucket are left out of its listing.
+	publish         cloud
+	publishPrefix   string
+	assets          string
+	assetsPublished bool
+	published       map[string]bool
+
+	// metaCache holds what was read for the descriptions of the objects
+	// in the last listing, by key.
+	metaMu    sync.Mutex
+	metaCache map[string]cachedMeta
+
+	// thumbnailFailed holds the thumbnails that could not be made, so
+	// that they are not tried again until the object changes.
+	thumbnailMu     sync.Mutex
+	thumbnailFailed map[string]bool
+
+	// indexMu serializes changes to the listing and index file.
+	indexMu sync.Mutex
+
+	// mu guards the last listing, its search index and the pages rendered
+	// from it.
+	mu          sync.RWMutex
+	files       []object
+	lastUpdated string
+	search      *searchIndex
+	// thumbnails maps the names of thumbnails to the keys they are of.
+	thumbnails map[string][]string
+	rendered   map[string][]byte
+}
+
+// setFiles stores the latest listing of the mount, indexes it for search
+// and drops the pages rendered from the previous one.
+func (m *mount) setFiles(files []object, lastUpdated string) {
+	idx := newSearchIndex(files)
+	thumbs := map[string][]string{}
+	for _, f := range files {
+		if f.Thumbnail != "" {
+			thumbs[f.Thumbnail] = append(thumbs[f.Thumbnail], f.Name)
+		}
+	}
+
+	m.mu.Lock()
+	m.files = files
+	m.lastUpdated = lastUpdated
+	m.search = idx
+	m.thumbnails = thumbs
+	m.rendered = map[string][]byte{}
+	m.mu.Unlock()
+}
+
+// listing returns the latest listing of the mount.
+func (m *mount) listing() ([]object, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.files, m.lastUpdated
+}
+
+// openObject returns a reader for an object that can seek in it, and the
+// object from the listing, or from opening it if it is not listed yet.
+func (m *mount) openObject(ctx context.Context, key string) (*objectReader, object, error) {
+	files, _ := m.listing()
+	for _, f := range files {
+		if f.Name == key {
+			return newObjectReader(ctx, m.p, key, f.Size), f, nil
+		}
+	}
+
+	body, o, err := m.p.Open(ctx, key)
+	if err != nil {
+		return nil, object{}, err
+	}
+	reader := newObjectReader(ctx, m.p, key, o.Size)
+	reader.body = body
+	return reader, o, nil
+}
+
+// updateIndex removes and adds objects to the listing of the mount, added
+// objects replacing any with the same name, and rewrites the index so the
+// changes show up right away.
+func (m *mount) updateIndex(ctx context.Context, remove []string, add ...object) error {
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+
+	drop := map[string]bool{}
+	for _, k := range remove {
+		drop[k] = true
+	}
+	for _, o := range add {
+		drop[o.Name] = true
+	}
+
+	m.mu.RLock()
+	files := make([]object, 0, len(m.files)+len(add))
+	for _, f := range m.files {
+		if !drop[f.Name] {
+			files = append(files, f)
+		}
+	}
+	m.mu.RUnlock()
+
+	files = append(files, add...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return m.writeIndex(ctx, files)
+}
+
+// bucketKey returns the key in the bucket for a key relative to the
+// mount's bucket prefix. A trailing slash on rel is kept, so directories
+// stay directories.
+func (m *mount) bucketKey(rel string) string {
+	prefix := m.keyPrefix()
+	if rel == "" {
+		return prefix
+	}
+	key := strings.TrimPrefix(path.Join(prefix, rel), "/")
+	if strings.HasSuffix(rel, "/") && key != "" && !strings.HasSuffix(key, "/") {
+		key += "/"
+	}
+	return key
+}
+
+// relativeKey returns the key relative to the mount's bucket prefix, or ""
+// if the key is outside of it.
+func (m *mount) relativeKey(key string) string {
+	prefix := m.keyPrefix()
+	if !strings.HasPrefix(key, prefix) {
+		return ""
+	}
+	return key[len(prefix):]
+}
+
+var (
+	// mountConfigs holds the mounts from the last applied config.
+	mountConfigs []mountConfig
+
+	mountsMu sync.RWMutex
+	mounts   []*mount
+)
+
+// resolveMounts returns the configured mounts with defaults taken from the
+// flags. If no mounts are configured, a single mount is returned for the
+// -bucket flag and served at /.
+func resolveMounts(configs []mountConfig) ([]mountConfig, error) {
+	if len(configs) == 0 {
+		c := mountConfig{
+			Name:     "default",
+			Path:     "/",
+			Provider: provider,
+			Bucket:   bucket,
+			Interval: interval,
+		}
+		c.S3.Key = s3AccessKey
+		c.S3.Secret = s3SecretKey
+		c.S3.Region = s3Region
+		return []mountConfig{c}, nil
+	}
+
+	resolved := make([]mountConfig, 0, len(configs))
+	seen := map[string]bool{}
+	seenHosts := map[string]bool{}
+	for _, c := range configs {
+		if c.Bucket == "" {
+			return nil, fmt.Errorf("mount %q has no bucket", c.Name)
+		}
+		if c.Name == "" {
+			c.Name = strings.Trim(c.Path, "/")
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("mount for bucket %s needs a name or path", c.Bucket)
+		}
+		if c.Path == "" {
+			c.Path = c.Name
+		}
+		c.Path = path.Clean("/"+c.Path) + "/"
+		if c.Path == "//" {
+			c.Path = "/"
+		}
+		if seen[c.Path] {
+			return nil, fmt.Errorf("mount %q: path %s is used by more than one mount", c.Name, c.Path)
+		}
+		seen[c.Path] = true
+		for _, r := range servedPaths() {
+			if strings.HasPrefix(c.Path, r) {
+				return nil, fmt.Errorf("mount %q: path %s is reserved", c.Name, c.Path)
+			}
+		}
+
+		hosts := make([]string, len(c.Hosts))
+		for i, h := range c.Hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if h == "" {
+				return nil, fmt.Errorf("mount %q has an empty host", c.Name)
+			}
+			if seenHosts[h] {
+				return nil, fmt.Errorf("mount %q: host %s is used by more than one mount", c.Name, h)
+			}
+			seenHosts[h] = true
+			hosts[i] = h
+		}
+		c.Hosts = hosts
+
+		if c.Provider == "" {
+			c.Provider = provider
+		}
+		if c.Provider != "s3" && c.Provider != "gcs" && c.Provider != "file" {
+			return nil, fmt.Errorf("mount %q: %s is not a valid provider, try `s3`, `gcs` or `file`", c.Name, c.Provider)
+		}
+		if c.Interval == 0 {
+			c.Interval = interval
+		}
+		if c.Interval < 0 {
+			return nil, fmt.Errorf("mount %q: interval must be greater than 0, got %s", c.Name, c.Interval)
+		}
+
+		// Credentials can be overridden from the environment, ex.
+		// S3SERVER_MOUNTS_GIFS_S3_SECRET.
+		if v, ok := os.LookupEnv(envName("mounts." + c.Name + ".s3.key")); ok {
+			c.S3.Key = v
+		}
+		if v, ok := os.LookupEnv(envName("mounts." + c.Name + ".s3.secret")); ok {
+			c.S3.Secret = v
+		}
+		if c.S3.Key == "" && c.S3.Secret == "" {
+			c.S3.Key = s3AccessKey
+			c.S3.Secret = s3SecretKey
+		}
+		if c.S3.Region == "" {
+			c.S3.Region = s3Region
+		}
+
+		resolved = append(resolved, c)
+	}
+	return resolved, nil
+}
+
+// newMount creates the provider for a mount and works out where its
+// template lives and where its index is written.
+func newMount(c mountConfig, staticDir string) (*mount, error) {
+	p, err := newProvider(c.Provider, c.Bucket, c.S3.Region, c.S3.Key, c.S3.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("mount %q: creating new provider failed: %v", c.Name, err)
+	}
+
+	tmpl := c.Template
+	if tmpl == "" {
+		tmpl = filepath.Join(templateDir(staticDir), "layout.html")
+	}
+
+	m := &mount{
+		name:     c.Name,
+		path:     c.Path,
+		hosts:    c.Hosts,
+		provider: c.Provider,
+		interval: c.Interval,
+		template: tmpl,
+		index:    filepath.Join(staticDir, filepath.FromSlash(c.Path), "index.html"),
+		p:        p,
+		status:   &indexStatus{},
+		stop:     make(chan struct{}),
+		assets:   staticDir,
+	}
+	configMu.RLock()
+	pub, pubBucket := publish, publishBucket
+	configMu.RUnlock()
+	if pub {
+		if err := m.setupPublish(c, pubBucket); err != nil {
+			return nil, fmt.Errorf("mount %q: %v", c.Name, err)
+		}
+	}
+	return m, nil
+}
+
+// templateDir returns the directory holding the templates.
+func templateDir(staticDir string) string {
+	configMu.RLock()
+	dir := templates
+	configMu.RUnlock()
+	if dir != "" {
+		return dir
+	}
+	return filepath.Join(staticDir, "../templates")
+}
+
+// run creates a new index for the mount every interval until it is stopped.
+func (m *mount) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			if err := m.createStaticIndex(ctx); err != nil {
+				logrus.Warnf("creating static index for mount %s failed: %v", m.name, err)
+			}
+		}
+	}
+}
+
+// startMounts creates the mounts from the current config, builds their
+// first index and starts their refresh loops, stopping any mounts that
+// were running before. If anything fails, the running mounts are kept.
+func startMounts(ctx context.Context, staticDir string) error {
+	configMu.RLock()
+	configs, err := resolveMounts(mountConfigs)
+	configMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	next := make([]*mount, 0, len(configs))
+	for _, c := range configs {
+		m, err := newMount(c, staticDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(m.index), 0755); err != nil {
+			return fmt.Errorf("mount %q: creating index directory failed: %v", m.name, err)
+		}
+		if err := m.createStaticIndex(ctx); err != nil {
+			return fmt.Errorf("mount %q: creating initial static index failed: %v", m.name, err)
+		}
+		next = append(next, m)
+	}
+
+	mountsMu.Lock()
+	previous := mounts
+	mounts = next
+	mountsMu.Unlock()
+
+	// Stop the previous mounts and remove any index they left behind.
+	indexes := map[string]bool{}
+	for _, m := range next {
+		indexes[m.index] = true
+	}
+	for _, m := range previous {
+		close(m.stop)
+		if !indexes[m.index] {
+			os.Remove(m.index)
+		}
+	}
+
+	for _, m := range next {
+		go m.run(ctx)
+	}
+
+	return createLandingPage(staticDir, staticDir, next)
+}
+
+// mountSettings returns the resolved mount configs in a form that can be
+// compared across reloads.
+func mountSettings() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	configs, err := resolveMounts(mountConfigs)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%+v %s %t %s", configs, templates, publish, publishBucket)
+}
+
+// requestHost returns the host of the request in lower case, without the
+// port.
+func requestHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if hh, _, err := net.SplitHostPort(host); err == nil {
+		host = hh
+	}
+	return host
+}
+
+// hostHandler routes requests by their Host header. A request for a host
+// that belongs to a mount is served that mount's index at /, and cannot
+// reach the indexes of other mounts. Any other request is passed on as is.
+func hostHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := requestHost(r)
+
+		var match *mount
+		var others []string
+		mountsMu.RLock()
+		for _, m := range mounts {
+			found := false
+			for _, mh := range m.hosts {
+				if mh == host {
+					found = true
+					break
+				}
+			}
+			if found {
+				match = m
+			} else if m.path != "/" {
+				others = append(others, m.path)
+			}
+		}
+		mountsMu.RUnlock()
+
+		if match == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		for _, o := range others {
+			if strings.HasPrefix(r.URL.Path, o) && !strings.HasPrefix(r.URL.Path, match.path) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = match.path
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type landingData struct {
+	LastUpdated string
+	Mounts      []landingMount
+}
+
+type landingMount struct {
+	Name string
+	Path string
+}
+
+// createLandingPage writes an index.html linking to every mount at the root
+// of outDir, unless a mount is already served at /.
+func createLandingPage(staticDir, outDir string, ms []*mount) error {
+	d := landingData{
+		LastUpdated: time.Now().Local().Format(time.RFC1123),
+	}
+	for _, m := range ms {
+		if m.path == "/" {
+			return nil
+		}
+		d.Mounts = append(d.Mounts, landingMount{Name: m.name, Path: m.path})
+	}
+
+	lp := filepath.Join(templateDir(staticDir), "landing.html")
+	tmpl, err := template.New("").ParseFiles(lp)
+	if err != nil {
+		return fmt.Errorf("parsing landing template failed: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "s3server")
+	if err != nil {
+		return fmt.Errorf("creating temp file failed: %v", err)
+	}
+	defer f.Close()
+	defer os.Remove(f.Name())
+
+	if err := tmpl.ExecuteTemplate(f, "landing", d); err != nil {
+		return fmt.Errorf("execute landing template failed: %v", err)
+	}
+	f.Close()
+
+	index := filepath.Join(outDir, "index.html")
+	if _, err := moveFile(index, f.Name()); err != nil {
+		return fmt.Errorf("renaming result from %s to %s failed: %v", f.Name(), index, err)
+	}
+	return nil
+}
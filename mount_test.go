@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveMountsReservedPaths(t *testing.T) {
+	provider, interval = "s3", time.Minute
+	webdavPath, s3GatewayPath = "/dav", "s3/"
+	defer func() { webdavPath, s3GatewayPath = "", "" }()
+
+	for _, c := range []struct {
+		path     string
+		reserved bool
+	}{
+		{"/gifs", false},
+		{"/metrics", true},
+		{"/-/gifs", true},
+		{"/metricsx", false},
+		{"/api", true},
+		{"/api/v2", true},
+		{"/auth", true},
+		{"/dav", true},
+		{"/dav/gifs", true},
+		{"/s3", true},
+		{"/davinci", false},
+	} {
+		_, err := resolveMounts([]mountConfig{{Name: "m", Path: c.path, Bucket: "b"}})
+		if reserved := err != nil && strings.Contains(err.Error(), "is reserved"); reserved != c.reserved {
+			t.Errorf("%s: got error %v, want reserved %t", c.path, err, c.reserved)
+		}
+	}
+}
+
+func TestBucketKey(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		rel    string
+		want   string
+	}{
+		{"/", "", ""},
+		{"/", "dance.gif", "dance.gif"},
+		{"/", "reactions/", "reactions/"},
+		{"gifs", "", "gifs/"},
+		{"gifs", "dance.gif", "gifs/dance.gif"},
+		{"gifs/", "dance.gif", "gifs/dance.gif"},
+		{"gifs", "reactions/", "gifs/reactions/"},
+		{"gifs", "/reactions/dance.gif", "gifs/reactions/dance.gif"},
+		{"gifs/reactions", "dance.gif", "gifs/reactions/dance.gif"},
+	} {
+		m := &mount{name: "gifs", p: newFakeCloud(c.prefix, nil)}
+		if got := m.bucketKey(c.rel); got != c.want {
+			t.Errorf("prefix %q, rel %q: got %q, want %q", c.prefix, c.rel, got, c.want)
+		}
+	}
+}
+
+func TestRelativeKey(t *testing.T) {
+	for _, c := range []struct {
+		prefix string
+		key    string
+		want   string
+	}{
+		{"/", "dance.gif", "dance.gif"},
+		{"gifs", "gifs/dance.gif", "dance.gif"},
+		{"gifs/", "gifs/reactions/dance.gif", "reactions/dance.gif"},
+		{"gifs", "gifs-private/dance.gif", ""},
+		{"gifs", "gifsdance.gif", ""},
+		{"gifs", "other/dance.gif", ""},
+	} {
+		m := &mount{name: "gifs", p: newFakeCloud(c.prefix, nil)}
+		if got := m.relativeKey(c.key); got != c.want {
+			t.Errorf("prefix %q, key %q: got %q, want %q", c.prefix, c.key, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "s3server_session"
+	loginCookie   = "s3server_login"
+
+	// sessionPurpose and loginPurpose are signed into the values of the
+	// cookies, so that one cannot be passed off as the other.
+	sessionPurpose = "session"
+	loginPurpose   = "login"
+)
+
+// oidcConfig is the OpenID Connect section of the auth config.
+type oidcConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+	UserClaim    string   `yaml:"user_claim"`
+	GroupsClaim  string   `yaml:"groups_claim"`
+}
+
+// oidcAuth logs users in with an OpenID Connect provider and keeps them
+// logged in with a session cookie.
+type oidcAuth struct {
+	config   oidcConfig
+	sessions *sessionStore
+	client   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCAuth(c oidcConfig, sessions *sessionStore) (*oidcAuth, error) {
+	if v, ok := os.LookupEnv(envName("auth.oidc.client_secret")); ok {
+		c.ClientSecret = v
+	}
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, errors.New("oidc needs an issuer, client_id and redirect_url")
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	if c.UserClaim == "" {
+		c.UserClaim = "email"
+	}
+
+	return &oidcAuth{
+		config:   c,
+		sessions: sessions,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// authenticate returns the identity from the session cookie.
+func (o *oidcAuth) authenticate(r *http.Request) (*identity, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, errNoCredentials
+	}
+	var id identity
+	if err := o.sessions.decode(c.Value, sessionPurpose, &id); err != nil {
+		return nil, err
+	}
+	if id.User == "" {
+		return nil, errors.New("session has no user")
+	}
+	return &id, nil
+}
+
+// ServeHTTP handles the /auth/login, /auth/callback and /auth/logout
+// endpoints.
+func (o *oidcAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/auth/login":
+		o.login(w, r)
+	case "/auth/callback":
+		o.callback(w, r)
+	case "/auth/logout":
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+}
+
+// localRedirect returns rd if it is a path on this server, or "/". Browsers
+// treat a backslash like a slash, so "/\host" is another site too.
+func localRedirect(rd string) string {
+	u, err := url.Parse(rd)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(rd, "/") || strings.HasPrefix(rd, "//") || strings.Contains(rd, "\\") {
+		return "/"
+	}
+	return rd
+}
+
+func (o *oidcAuth) login(w http.ResponseWriter, r *http.Request) {
+	d, err := o.getDiscovery(r.Context())
+	if err != nil {
+		logrus.Warnf("oidc discovery failed: %v", err)
+		http.Error(w, "login is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	ls := loginState{State: randomString(), Nonce: randomString(), Redirect: localRedirect(r.URL.Query().Get("rd"))}
+	v, err := o.sessions.encode(loginPurpose, ls, 10*time.Minute)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    v,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, o.oauth2Config(d).AuthCodeURL(ls.State, oauth2.SetAuthURLParam("nonce", ls.Nonce)), http.StatusFound)
+}
+
+func (o *oidcAuth) callback(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(loginCookie)
+	if err != nil {
+		http.Error(w, "login expired, try again", http.StatusBadRequest)
+		return
+	}
+	var ls loginState
+	if err := o.sessions.decode(c.Value, loginPurpose, &ls); err != nil || ls.State == "" || ls.State != r.URL.Query().Get("state") {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Value: "", Path: "/auth/", MaxAge: -1})
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	d, err := o.getDiscovery(r.Context())
+	if err != nil {
+		logrus.Warnf("oidc discovery failed: %v", err)
+		http.Error(w, "login is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, o.client)
+	token, err := o.oauth2Config(d).Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		logrus.Warnf("oidc code exchange failed: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	raw, _ := token.Extra("id_token").(string)
+	claims, err := o.verify(r.Context(), raw)
+	if err != nil {
+		logrus.Warnf("oidc id token verification failed: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != ls.Nonce {
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	id := identity{}
+	id.User, _ = claims[o.config.UserClaim].(string)
+	if id.User == "" {
+		http.Error(w, "login failed: no "+o.config.UserClaim+" claim", http.StatusUnauthorized)
+		return
+	}
+	if o.config.GroupsClaim != "" {
+		groups, _ := claims[o.config.GroupsClaim].([]interface{})
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+
+	v, err := o.sessions.encode(sessionPurpose, id, o.sessions.ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    v,
+		Path:     "/",
+		MaxAge:   int(o.sessions.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, ls.Redirect, http.StatusFound)
+}
+
+func (o *oidcAuth) oauth2Config(d *oidcDiscovery) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.config.ClientID,
+		ClientSecret: o.config.ClientSecret,
+		RedirectURL:  o.config.RedirectURL,
+		Scopes:       o.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+}
+
+// getDiscovery fetches and caches the provider's discovery document.
+func (o *oidcAuth) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := o.getJSON(ctx, strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("issuer %q does not match the configured issuer %q", d.Issuer, o.config.Issuer)
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+func (o *oidcAuth) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s failed: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the signing key with the given id, refreshing the key set
+// from the provider if it is not known.
+func (o *oidcAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := o.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			logrus.Debugf("skipping oidc key %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	o.keys = keys
+
+	k, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verify checks the signature, issuer, audience and expiry of an ID token
+// and returns its claims.
+func (o *oidcAuth) verify(ctx context.Context, raw string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unexpected algorithm %s for an RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("unexpected algorithm %s for an EC key", header.Alg)
+		}
+		if !ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid id token signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != o.config.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !audienceContains(claims["aud"], o.config.ClientID) {
+		return nil, errors.New("id token is not for this client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("id token has expired")
+	}
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sessionStore signs and verifies the values stored in cookies.
+type sessionStore struct {
+	key []byte
+	ttl time.Duration
+}
+
+var (
+	// randomSessionKey is the key used without a configured one. It is
+	// made once, so that reloading the config keeps users logged in.
+	randomSessionKey     []byte
+	randomSessionKeyOnce sync.Once
+	randomSessionKeyErr  error
+)
+
+// newSessionStore returns a session store signing with key. Without a key,
+// a random one is used and sessions do not survive a restart.
+func newSessionStore(key string, ttl time.Duration) (*sessionStore, error) {
+	if key == "" {
+		randomSessionKeyOnce.Do(func() {
+			randomSessionKey = make([]byte, 32)
+			_, randomSessionKeyErr = rand.Read(randomSessionKey)
+		})
+		if randomSessionKeyErr != nil {
+			return nil, randomSessionKeyErr
+		}
+		return &sessionStore{key: randomSessionKey, ttl: ttl}, nil
+	}
+	if len(key) < 32 {
+		return nil, errors.New("auth session key must be at least 32 characters")
+	}
+	return &sessionStore{key: []byte(key), ttl: ttl}, nil
+}
+
+type sessionValue struct {
+	Purpose string          `json:"p"`
+	Expires int64           `json:"exp"`
+	Value   json.RawMessage `json:"v"`
+}
+
+// encode signs v for the purpose so that it is valid for ttl.
+func (s *sessionStore) encode(purpose string, v interface{}, ttl time.Duration) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	b, err = json.Marshal(sessionValue{Purpose: purpose, Expires: time.Now().Add(ttl).Unix(), Value: b})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + s.sign(payload), nil
+}
+
+// decode verifies the signature, purpose and expiry of a value from encode
+// and decodes it into v.
+func (s *sessionStore) decode(value, purpose string, v interface{}) error {
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return errors.New("invalid session")
+	}
+
+	var sv sessionValue
+	if err := decodeSegment(parts[0], &sv); err != nil {
+		return err
+	}
+	if sv.Purpose != purpose {
+		return errors.New("invalid session")
+	}
+	if time.Now().Unix() > sv.Expires {
+		return errors.New("session has expired")
+	}
+	return json.Unmarshal(sv.Value, v)
+}
+
+func (s *sessionStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID Connect provider that logs in one user.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	nonce string
+	codes int
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kid: "test",
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.codes++
+		nonce := m.nonce
+		m.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token": m.sign(t, map[string]interface{}{
+				"iss":    m.URL,
+				"aud":    "s3server",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+				"nonce":  nonce,
+				"email":  "alice@example.com",
+				"groups": []string{"editors"},
+			}),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// cookie returns the value of the named cookie set by the response.
+func cookie(t *testing.T, w *httptest.ResponseRecorder, name string) string {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return c.Value
+		}
+	}
+	t.Fatalf("response did not set the %s cookie", name)
+	return ""
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	sessions, err := newSessionStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := newOIDCAuth(oidcConfig{
+		Issuer:       issuer.URL,
+		ClientID:     "s3server",
+		ClientSecret: "secret",
+		RedirectURL:  "http://gifs.example.com/auth/callback",
+		GroupsClaim:  "groups",
+	}, sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// login redirects to the provider with a state and nonce
+	w := httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?rd=/gifs/", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", w.Code, http.StatusFound)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), issuer.URL+"/authorize") {
+		t.Fatalf("login redirected to %s", w.Header().Get("Location"))
+	}
+	state, nonce := loc.Query().Get("state"), loc.Query().Get("nonce")
+	if state == "" || nonce == "" {
+		t.Fatalf("login redirect has no state or nonce: %s", loc)
+	}
+	issuer.mu.Lock()
+	issuer.nonce = nonce
+	issuer.mu.Unlock()
+	login := cookie(t, w, loginCookie)
+
+	// a redirect to another site is dropped
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login?rd="+url.QueryEscape(`/\evil.example`), nil))
+	var ls loginState
+	if err := sessions.decode(cookie(t, w, loginCookie), loginPurpose, &ls); err != nil || ls.Redirect != "/" {
+		t.Errorf("login to /\\evil.example: got redirect %q, %v, want /", ls.Redirect, err)
+	}
+
+	// the login cookie is not a session
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: login})
+	if id, err := o.authenticate(r); err == nil || err == errNoCredentials || id != nil {
+		t.Fatalf("login cookie as session: got %v, %v, want an error", id, err)
+	}
+
+	// a wrong state is rejected
+	r = httptest.NewRequest("GET", "/auth/callback?code=good-code&state=wrong", nil)
+	r.AddCookie(&http.Cookie{Name: loginCookie, Value: login})
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback with the wrong state: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// the callback exchanges the code and sets the session
+	r = httptest.NewRequest("GET", "/auth/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	r.AddCookie(&http.Cookie{Name: loginCookie, Value: login})
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/gifs/" {
+		t.Fatalf("callback: got status %d to %q, want %d to /gifs/: %s", w.Code, w.Header().Get("Location"), http.StatusFound, w.Body)
+	}
+	issuer.mu.Lock()
+	if issuer.codes != 1 {
+		t.Errorf("expected one code exchange, got %d", issuer.codes)
+	}
+	issuer.mu.Unlock()
+	session := cookie(t, w, sessionCookie)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	id, err := o.authenticate(r)
+	if err != nil {
+		t.Fatalf("authenticating with the session failed: %v", err)
+	}
+	if id.User != "alice@example.com" || len(id.Groups) != 1 || id.Groups[0] != "editors" {
+		t.Errorf("got identity %+v", id)
+	}
+
+	// the session is not a login state either
+	r = httptest.NewRequest("GET", "/auth/callback?code=good-code&state="+url.QueryEscape(state), nil)
+	r.AddCookie(&http.Cookie{Name: loginCookie, Value: session})
+	w = httptest.NewRecorder()
+	o.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("callback with a session as the login: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// a session without a user is rejected
+	empty, err := sessions.encode(sessionPurpose, identity{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: empty})
+	if id, err := o.authenticate(r); err == nil || id != nil {
+		t.Errorf("session without a user: got %v, %v, want an error", id, err)
+	}
+
+	// sessions survive a config reload without a session key
+	reloaded, err := newSessionStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got identity
+	if err := reloaded.decode(session, sessionPurpose, &got); err != nil || got.User != "alice@example.com" {
+		t.Errorf("decoding the session after a reload: got %+v, %v", got, err)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	for rd, want := range map[string]string{
+		"":                      "/",
+		"/":                     "/",
+		"/gifs/":                "/gifs/",
+		"/view/dance.gif?x=1":   "/view/dance.gif?x=1",
+		"gifs/":                 "/",
+		"//evil.example":        "/",
+		`/\evil.example`:        "/",
+		`/gifs\..\evil`:         "/",
+		"https://evil.example/": "/",
+		"javascript:alert(1)":   "/",
+		"/\tevil.example":       "/",
+		"/%2F/evil.example":     "/%2F/evil.example",
+		"/\x00":                 "/",
+	} {
+		if got := localRedirect(rd); got != want {
+			t.Errorf("localRedirect(%q) = %q, want %q", rd, got, want)
+		}
+	}
+}
@@ -3,20 +3,47 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
+	"golang.org/x/oauth2/google"
 )
 
 type cloud interface {
-	List(prefix, delimiter, marker string, max int, q *storage.Query) ([]object, error)
+	List(ctx context.Context, prefix, delimiter, marker string, max int, q *storage.Query) ([]object, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, object, error)
+	// OpenRange returns a reader for an object from offset to its end.
+	OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, object, error)
+	// Stat describes an object without reading it.
+	Stat(ctx context.Context, key string) (object, error)
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (object, error)
+	Publish(ctx context.Context, key string, data []byte, contentType, cacheControl string) error
+	// Metadata returns the user-defined metadata of an object, for
+	// providers whose listings leave it out.
+	Metadata(ctx context.Context, key string) (map[string]string, error)
+	Delete(ctx context.Context, keys ...string) error
+	Copy(ctx context.Context, src, dst string) (object, error)
+	Move(ctx context.Context, src, dst string) (object, error)
+
+	// Resumable uploads are sent in parts that can be spread over
+	// several requests, or restarts, and are put together on completion.
+	InitUpload(ctx context.Context, key, contentType string) (string, error)
+	UploadPart(ctx context.Context, key, uploadID string, n int, offset int64, r io.ReadSeeker, size, total int64) (string, error)
+	CompleteUpload(ctx context.Context, key, uploadID string, parts []uploadPart) (object, error)
+	AbortUpload(ctx context.Context, key, uploadID string) error
 	Prefix() string
 	BaseURL() string
 }
 
 func newProvider(provider, bucket, s3Region, s3AccessKey, s3SecretKey string) (cloud, error) {
+	if provider == "file" {
+		return newFSProvider(bucket)
+	}
+
 	if provider == "s3" {
 		// auth with aws
 		auth, err := aws.GetAuth(s3AccessKey, s3SecretKey)
@@ -45,6 +72,10 @@ func newProvider(provider, bucket, s3Region, s3AccessKey, s3SecretKey string) (c
 		return nil, err
 	}
 	p.client = client
+	p.hc, err = google.DefaultClient(p.ctx, storage.ScopeReadWrite)
+	if err != nil {
+		return nil, err
+	}
 	p.bucket, p.prefix = cleanBucketName(p.bucket)
 	p.b = client.Bucket(p.bucket)
 	p.baseURL = p.bucket
@@ -54,6 +85,13 @@ func newProvider(provider, bucket, s3Region, s3AccessKey, s3SecretKey string) (c
 	return &p, nil
 }
 
+// uploadPart is a part of a resumable upload that has been sent.
+type uploadPart struct {
+	N    int    `json:"n"`
+	ETag string `json:"etag,omitempty"`
+	Size int64  `json:"size"`
+}
+
 // cleanBucketName returns the bucket and prefix
 // for a given s3bucket.
 func cleanBucketName(bucket string) (string, string) {
@@ -87,3 +125,61 @@ func getRegion(name string) (aws.Region, error) {
 	}
 	return region, nil
 }
+
+// objectReader reads an object and can seek in it, so it can be served
+// with http.ServeContent. The object is streamed from the provider on the
+// first read, and seeking reopens it at the new offset with a ranged get.
+type objectReader struct {
+	ctx  context.Context
+	p    cloud
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func newObjectReader(ctx context.Context, p cloud, key string, size int64) *objectReader {
+	return &objectReader{ctx: ctx, p: p, key: key, size: size}
+}
+
+func (f *objectReader) Read(p []byte) (int, error) {
+	if f.body == nil {
+		if f.pos >= f.size {
+			return 0, io.EOF
+		}
+		body, _, err := f.p.OpenRange(f.ctx, f.key, f.pos)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *objectReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.size
+	}
+	if pos < 0 {
+		return 0, os.ErrInvalid
+	}
+	if pos != f.pos && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *objectReader) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// fakeCloud is an in-memory bucket for tests. Methods that are not
+// implemented panic through the nil embedded interface.
+type fakeCloud struct {
+	cloud
+
+	prefix  string
+	baseURL string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+	// opened counts the bytes returned by Open.
+	opened int64
+	// pageSize limits the keys in a page of a listing, pages counts the
+	// pages listed.
+	pageSize int
+	pages    int
+	// uploads holds the parts of the resumable uploads in progress.
+	uploads map[string]map[int][]byte
+	// metadata holds the user-defined metadata of objects, and
+	// metadataReads counts the calls to Metadata.
+	metadata      map[string]map[string]string
+	metadataReads int
+}
+
+func newFakeCloud(prefix string, objects map[string]string) *fakeCloud {
+	c := &fakeCloud{prefix: prefix, baseURL: "bucket.example.com", objects: map[string][]byte{}, types: map[string]string{}}
+	for k, v := range objects {
+		c.objects[k] = []byte(v)
+	}
+	return c
+}
+
+func (c *fakeCloud) Prefix() string  { return c.prefix }
+func (c *fakeCloud) BaseURL() string { return c.baseURL }
+
+func (c *fakeCloud) object(key string) object {
+	return object{
+		Name:        key,
+		BaseURL:     c.baseURL,
+		Size:        int64(len(c.objects[key])),
+		ContentType: c.types[key],
+		Modified:    time.Unix(1500000000, 0),
+	}
+}
+
+// List lists the objects the way S3 does: a page holds at most max keys,
+// or pageSize if it is set, and keys with the delimiter after the prefix
+// are left out. The pages are followed like in s3Provider.
+func (c *fakeCloud) List(ctx context.Context, prefix, delimiter, marker string, max int, q *storage.Query) ([]object, error) {
+	c.mu.Lock()
+	prefix = strings.TrimPrefix(prefix, "/")
+	var keys []string
+	for k := range c.objects {
+		if strings.HasPrefix(k, prefix) && k > marker && (delimiter == "" || !strings.Contains(k[len(prefix):], delimiter)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	size := max
+	if c.pageSize > 0 {
+		size = c.pageSize
+	}
+	truncated := size > 0 && len(keys) > size
+	if truncated {
+		keys = keys[:size]
+	}
+	var files []object
+	for _, k := range keys {
+		files = append(files, c.object(k))
+	}
+	c.pages++
+	c.mu.Unlock()
+
+	if !truncated {
+		return files, nil
+	}
+	rest, err := c.List(ctx, prefix, delimiter, keys[len(keys)-1], max, q)
+	if err != nil {
+		return nil, err
+	}
+	return append(files, rest...), nil
+}
+
+func (c *fakeCloud) Open(ctx context.Context, key string) (io.ReadCloser, object, error) {
+	return c.OpenRange(ctx, key, 0)
+}
+
+func (c *fakeCloud) OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, object, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.objects[key]
+	if !ok {
+		return nil, object{}, os.ErrNotExist
+	}
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	c.opened += int64(len(b)) - offset
+	return ioutil.NopCloser(bytes.NewReader(b[offset:])), c.object(key), nil
+}
+
+func (c *fakeCloud) Stat(ctx context.Context, key string) (object, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.objects[key]; !ok {
+		return object{}, os.ErrNotExist
+	}
+	return c.object(key), nil
+}
+
+func (c *fakeCloud) Metadata(ctx context.Context, key string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.objects[key]; !ok {
+		return nil, os.ErrNotExist
+	}
+	c.metadataReads++
+	md := map[string]string{}
+	for k, v := range c.metadata[key] {
+		md[k] = v
+	}
+	return md, nil
+}
+
+func (c *fakeCloud) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (object, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return object{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[key] = b
+	c.types[key] = contentType
+	return c.object(key), nil
+}
+
+func (c *fakeCloud) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		delete(c.objects, k)
+		delete(c.types, k)
+	}
+	return nil
+}
+
+func (c *fakeCloud) Copy(ctx context.Context, src, dst string) (object, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.objects[src]
+	if !ok {
+		return object{}, os.ErrNotExist
+	}
+	c.objects[dst] = append([]byte(nil), b...)
+	c.types[dst] = c.types[src]
+	return c.object(dst), nil
+}
+
+func (c *fakeCloud) Move(ctx context.Context, src, dst string) (object, error) {
+	o, err := c.Copy(ctx, src, dst)
+	if err != nil {
+		return object{}, err
+	}
+	return o, c.Delete(ctx, src)
+}
+
+func (c *fakeCloud) InitUpload(ctx context.Context, key, contentType string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads == nil {
+		c.uploads = map[string]map[int][]byte{}
+	}
+	id := fmt.Sprintf("upload-%d", len(c.uploads)+1)
+	c.uploads[id] = map[int][]byte{}
+	c.types[key] = contentType
+	return id, nil
+}
+
+func (c *fakeCloud) UploadPart(ctx context.Context, key, uploadID string, n int, offset int64, r io.ReadSeeker, size, total int64) (string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parts, ok := c.uploads[uploadID]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	parts[n] = b
+	return fmt.Sprintf("etag-%d", n), nil
+}
+
+func (c *fakeCloud) CompleteUpload(ctx context.Context, key, uploadID string, parts []uploadPart) (object, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, ok := c.uploads[uploadID]
+	if !ok {
+		return object{}, os.ErrNotExist
+	}
+	var b []byte
+	for _, p := range parts {
+		b = append(b, sent[p.N]...)
+	}
+	delete(c.uploads, uploadID)
+	c.objects[key] = b
+	return c.object(key), nil
+}
+
+func (c *fakeCloud) AbortUpload(ctx context.Context, key, uploadID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.uploads, uploadID)
+	return nil
+}
+
+func TestObjectReaderSeek(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{"dance.gif": "0123456789"})
+	f := newObjectReader(context.Background(), p, "dance.gif", 10)
+	defer f.Close()
+
+	if _, err := f.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "789" {
+		t.Errorf("reading from 7: got %q, %v", b, err)
+	}
+	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "67" {
+		t.Errorf("reading from 6: got %q, %v", buf, err)
+	}
+	if _, err := f.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("reading at the end: got %d, %v", n, err)
+	}
+
+	// seeking opens the object at the offset rather than reading past it
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.opened != 7 {
+		t.Errorf("opened %d bytes, want 7", p.opened)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// publishAssetsCacheControl is the Cache-Control of published assets,
+// which only change with a new release.
+const publishAssetsCacheControl = "public, max-age=86400"
+
+// setupPublish sets where the mount publishes its index and assets: the
+// root of its own bucket, or the publish bucket path if one is given.
+func (m *mount) setupPublish(c mountConfig, publishTo string) error {
+	m.publish = m.p
+	bucket := c.Bucket
+	if publishTo != "" {
+		p, err := newProvider(c.Provider, publishTo, c.S3.Region, c.S3.Key, c.S3.Secret)
+		if err != nil {
+			return fmt.Errorf("creating publish provider failed: %v", err)
+		}
+		m.publish = p
+		m.publishPrefix = strings.TrimPrefix(p.Prefix(), "/")
+		if m.publishPrefix != "" && !strings.HasSuffix(m.publishPrefix, "/") {
+			m.publishPrefix += "/"
+		}
+		bucket = publishTo
+	}
+
+	// keep the published keys out of the listing of the mount's bucket
+	own, _ := cleanBucketName(c.Bucket)
+	target, _ := cleanBucketName(bucket)
+	if own != target {
+		return nil
+	}
+	assets, err := assetFiles(m.assets)
+	if err != nil {
+		return fmt.Errorf("listing assets failed: %v", err)
+	}
+	m.published = map[string]bool{m.indexKey(): true}
+	for _, rel := range assets {
+		m.published[m.publishPrefix+rel] = true
+	}
+	return nil
+}
+
+// indexKey returns the key the index of the mount is published under.
+func (m *mount) indexKey() string {
+	return m.publishPrefix + strings.TrimPrefix(m.path, "/") + "index.html"
+}
+
+// withoutPublished returns files without the objects the mount publishes.
+func (m *mount) withoutPublished(files []object) []object {
+	if len(m.published) == 0 {
+		return files
+	}
+	kept := files[:0:0]
+	for _, f := range files {
+		if !m.published[f.Name] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// publishSite uploads the read-only index of the mount, and the assets the
+// first time, to its publish bucket. It must be called with indexMu held.
+func (m *mount) publishSite(ctx context.Context) error {
+	files, lastUpdated := m.listing()
+	var buf bytes.Buffer
+	if err := m.render(&buf, m.data(files, lastUpdated, true)); err != nil {
+		return err
+	}
+	configMu.RLock()
+	cacheControl := publishCacheControl
+	configMu.RUnlock()
+	if err := m.publish.Publish(ctx, m.indexKey(), buf.Bytes(), "text/html; charset=utf-8", cacheControl); err != nil {
+		return fmt.Errorf("publishing %s failed: %v", m.indexKey(), err)
+	}
+
+	if m.assetsPublished {
+		return nil
+	}
+	assets, err := assetFiles(m.assets)
+	if err != nil {
+		return fmt.Errorf("listing assets failed: %v", err)
+	}
+	for _, rel := range assets {
+		b, err := ioutil.ReadFile(filepath.Join(m.assets, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		if err := m.publish.Publish(ctx, m.publishPrefix+rel, b, contentTypeFor(rel, ""), publishAssetsCacheControl); err != nil {
+			return fmt.Errorf("publishing %s failed: %v", rel, err)
+		}
+	}
+	m.assetsPublished = true
+	return nil
+}
+
+// assetFiles returns the slash separated paths of the static assets,
+// leaving out the indexes generated by a server running from the same
+// directory.
+func assetFiles(staticDir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(staticDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == "index.html" {
+			return nil
+		}
+		rel, err := filepath.Rel(staticDir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, path.Clean(filepath.ToSlash(rel)))
+		return nil
+	})
+	return files, err
+}
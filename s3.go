@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
 	"cloud.google.com/go/storage"
 	"github.com/mitchellh/goamz/s3"
+	"go.opencensus.io/trace"
 )
 
 type s3Provider struct {
@@ -14,24 +24,48 @@ type s3Provider struct {
 }
 
 // List returns the files in an s3 bucket.
-func (c *s3Provider) List(prefix, delimiter, marker string, max int, q *storage.Query) (files []object, err error) {
+func (c *s3Provider) List(ctx context.Context, prefix, delimiter, marker string, max int, q *storage.Query) (files []object, err error) {
+	ctx, span := trace.StartSpan(ctx, "s3.List", trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(
+		trace.StringAttribute("bucket", c.bucket),
+		trace.StringAttribute("prefix", prefix),
+		trace.StringAttribute("marker", marker),
+	)
+
+	start := time.Now()
 	resp, err := c.b.List(prefix, delimiter, marker, max)
+	observeProviderCall("s3", "list", start, err)
+	setSpanError(span, err)
+	if err == nil {
+		span.AddAttributes(trace.Int64Attribute("objects", int64(len(resp.Contents))))
+	}
+	span.End()
 	if err != nil {
 		return nil, err
 	}
 
 	// append to files
 	for _, f := range resp.Contents {
+		modified, _ := time.Parse(time.RFC3339, f.LastModified)
 		files = append(files, object{
-			Name:    f.Key,
-			Size:    f.Size,
-			BaseURL: c.BaseURL(),
+			Name:     f.Key,
+			Size:     f.Size,
+			BaseURL:  c.BaseURL(),
+			Modified: modified,
+			ETag:     strings.Trim(f.ETag, `"`),
 		})
 	}
 
+	// S3 only sets the next marker when listing with a delimiter, otherwise
+	// the next page starts after the last key
+	next := resp.NextMarker
+	if next == "" && len(resp.Contents) > 0 {
+		next = resp.Contents[len(resp.Contents)-1].Key
+	}
+
 	// recursion for the recursion god
-	if resp.IsTruncated && resp.NextMarker != "" {
-		f, err := c.List(resp.Prefix, resp.Delimiter, resp.NextMarker, resp.MaxKeys, q)
+	if resp.IsTruncated && next != "" {
+		f, err := c.List(ctx, resp.Prefix, resp.Delimiter, next, resp.MaxKeys, q)
 		if err != nil {
 			return nil, err
 		}
@@ -43,6 +77,397 @@ func (c *s3Provider) List(prefix, delimiter, marker string, max int, q *storage.
 	return files, nil
 }
 
+// Open returns a reader for an object in an s3 bucket.
+func (c *s3Provider) Open(ctx context.Context, key string) (io.ReadCloser, object, error) {
+	_, span := trace.StartSpan(ctx, "s3.Get", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	resp, err := c.b.GetResponse(key)
+	observeProviderCall("s3", "get", start, err)
+	setSpanError(span, err)
+	if err != nil {
+		return nil, object{}, err
+	}
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.Body, object{
+		Name:        key,
+		Size:        resp.ContentLength,
+		BaseURL:     c.BaseURL(),
+		ContentType: resp.Header.Get("Content-Type"),
+		Modified:    modified,
+	}, nil
+}
+
+// OpenRange returns a reader for an object in an s3 bucket from offset on.
+// goamz has no ranged get, so the range is requested with a signed URL.
+func (c *s3Provider) OpenRange(ctx context.Context, key string, offset int64) (io.ReadCloser, object, error) {
+	if offset == 0 {
+		return c.Open(ctx, key)
+	}
+
+	_, span := trace.StartSpan(ctx, "s3.Get", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key), trace.Int64Attribute("offset", offset))
+
+	req, err := http.NewRequest(http.MethodGet, c.b.SignedURL(key, time.Now().Add(time.Hour)), nil)
+	if err != nil {
+		return nil, object{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil && resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		err = fmt.Errorf("getting %s failed: %s", key, resp.Status)
+	}
+	observeProviderCall("s3", "get", start, err)
+	setSpanError(span, err)
+	if err != nil {
+		return nil, object{}, err
+	}
+
+	o := object{
+		Name:        key,
+		Size:        offset + resp.ContentLength,
+		BaseURL:     c.BaseURL(),
+		ContentType: resp.Header.Get("Content-Type"),
+	}
+	o.Modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the offset is at or past the end of the object
+		resp.Body.Close()
+		o.Size = offset
+		return ioutil.NopCloser(strings.NewReader("")), o, nil
+	}
+	return resp.Body, o, nil
+}
+
+// multipartPartSize is the size of the parts that uploads larger than a
+// single part are split into.
+const multipartPartSize = 16 << 20
+
+// Put uploads an object to an s3 bucket. Uploads that are larger than a
+// part, or of unknown size that turn out to be, use a multipart upload.
+func (c *s3Provider) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (o object, err error) {
+	_, span := trace.StartSpan(ctx, "s3.Put", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "put", start, err)
+		setSpanError(span, err)
+	}()
+
+	acl := s3.ACL(currentUploadACL())
+	if size >= 0 && size < multipartPartSize {
+		if err := c.b.PutReader(key, r, size, contentType, acl); err != nil {
+			return object{}, err
+		}
+	} else if size, err = c.putMulti(key, r, contentType, acl); err != nil {
+		return object{}, err
+	}
+
+	return object{
+		Name:        key,
+		Size:        size,
+		BaseURL:     c.BaseURL(),
+		ContentType: contentType,
+		Modified:    time.Now(),
+	}, nil
+}
+
+// Publish uploads a small generated file, such as an index page, to an s3
+// bucket with the given headers.
+func (c *s3Provider) Publish(ctx context.Context, key string, data []byte, contentType, cacheControl string) (err error) {
+	_, span := trace.StartSpan(ctx, "s3.Publish", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "publish", start, err)
+		setSpanError(span, err)
+	}()
+
+	headers := map[string][]string{
+		"Content-Type":  {contentType},
+		"Cache-Control": {cacheControl},
+	}
+	return c.b.PutHeader(key, data, headers, s3.ACL(currentPublishACL()))
+}
+
+// Metadata returns the x-amz-meta-* headers of an object in an s3 bucket,
+// keyed by lower case name without the prefix.
+func (c *s3Provider) Metadata(ctx context.Context, key string) (md map[string]string, err error) {
+	_, span := trace.StartSpan(ctx, "s3.Head", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "head", start, err)
+		setSpanError(span, err)
+	}()
+
+	resp, err := c.b.Head(key)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	md = map[string]string{}
+	for k, v := range resp.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-meta-") && len(v) > 0 {
+			md[strings.TrimPrefix(name, "x-amz-meta-")] = v[0]
+		}
+	}
+	return md, nil
+}
+
+// Stat describes an object in an s3 bucket with a HEAD request.
+func (c *s3Provider) Stat(ctx context.Context, key string) (o object, err error) {
+	_, span := trace.StartSpan(ctx, "s3.Head", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "head", start, err)
+		setSpanError(span, err)
+	}()
+
+	resp, err := c.b.Head(key)
+	if err != nil {
+		return object{}, err
+	}
+	resp.Body.Close()
+	return c.headObject(key, resp), nil
+}
+
+// headObject describes an object from the response to a HEAD request.
+func (c *s3Provider) headObject(key string, resp *http.Response) object {
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return object{
+		Name:        key,
+		Size:        resp.ContentLength,
+		BaseURL:     c.BaseURL(),
+		ContentType: resp.Header.Get("Content-Type"),
+		Modified:    modified,
+		ETag:        strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+}
+
+// putMulti uploads an object in parts and returns its size. If it fits in
+// a single part, it is uploaded with a single request instead.
+func (c *s3Provider) putMulti(key string, r io.Reader, contentType string, acl s3.ACL) (int64, error) {
+	buf := make([]byte, multipartPartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), c.b.PutReader(key, bytes.NewReader(buf[:n]), int64(n), contentType, acl)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	multi, err := c.b.InitMulti(key, contentType, acl)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		parts []s3.Part
+		size  int64
+	)
+	for i := 1; n > 0; i++ {
+		part, err := multi.PutPart(i, bytes.NewReader(buf[:n]))
+		if err != nil {
+			multi.Abort()
+			return 0, err
+		}
+		parts = append(parts, part)
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			multi.Abort()
+			return 0, err
+		}
+	}
+
+	if err := multi.Complete(parts); err != nil {
+		multi.Abort()
+		return 0, err
+	}
+	return size, nil
+}
+
+// multiDelMax is the most keys a single s3 multi-object delete accepts.
+const multiDelMax = 1000
+
+// Delete removes objects from an s3 bucket.
+func (c *s3Provider) Delete(ctx context.Context, keys ...string) (err error) {
+	_, span := trace.StartSpan(ctx, "s3.Delete", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.Int64Attribute("keys", int64(len(keys))))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "delete", start, err)
+		setSpanError(span, err)
+	}()
+
+	if len(keys) == 1 {
+		return c.b.Del(keys[0])
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > multiDelMax {
+			n = multiDelMax
+		}
+		if err := c.b.MultiDel(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Copy copies an object within an s3 bucket.
+func (c *s3Provider) Copy(ctx context.Context, src, dst string) (o object, err error) {
+	_, span := trace.StartSpan(ctx, "s3.Copy", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("source", src),
+		trace.StringAttribute("destination", dst),
+	)
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "copy", start, err)
+		setSpanError(span, err)
+	}()
+
+	if err := c.b.Copy(src, dst, s3.ACL(currentUploadACL())); err != nil {
+		return object{}, err
+	}
+
+	resp, err := c.b.Head(dst)
+	if err != nil {
+		return object{}, err
+	}
+	resp.Body.Close()
+	return c.headObject(dst, resp), nil
+}
+
+// Move copies an object within an s3 bucket and deletes the original.
+func (c *s3Provider) Move(ctx context.Context, src, dst string) (object, error) {
+	o, err := c.Copy(ctx, src, dst)
+	if err != nil {
+		return object{}, err
+	}
+	return o, c.Delete(ctx, src)
+}
+
+// InitUpload starts a multipart upload to an s3 bucket and returns its
+// upload ID.
+func (c *s3Provider) InitUpload(ctx context.Context, key, contentType string) (id string, err error) {
+	_, span := trace.StartSpan(ctx, "s3.InitUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "init_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	multi, err := c.b.InitMulti(key, contentType, s3.ACL(currentUploadACL()))
+	if err != nil {
+		return "", err
+	}
+	return multi.UploadId, nil
+}
+
+func (c *s3Provider) multi(key, uploadID string) *s3.Multi {
+	return &s3.Multi{Bucket: c.b, Key: key, UploadId: uploadID}
+}
+
+// UploadPart sends part n of a multipart upload to an s3 bucket and
+// returns its ETag.
+func (c *s3Provider) UploadPart(ctx context.Context, key, uploadID string, n int, offset int64, r io.ReadSeeker, size, total int64) (etag string, err error) {
+	_, span := trace.StartSpan(ctx, "s3.UploadPart", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("key", key),
+		trace.Int64Attribute("part", int64(n)),
+	)
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "upload_part", start, err)
+		setSpanError(span, err)
+	}()
+
+	part, err := c.multi(key, uploadID).PutPart(n, r)
+	if err != nil {
+		return "", err
+	}
+	return part.ETag, nil
+}
+
+// CompleteUpload assembles the parts of a multipart upload to an s3
+// bucket into the object.
+func (c *s3Provider) CompleteUpload(ctx context.Context, key, uploadID string, parts []uploadPart) (o object, err error) {
+	_, span := trace.StartSpan(ctx, "s3.CompleteUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "complete_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	var size int64
+	s3Parts := make([]s3.Part, len(parts))
+	for i, p := range parts {
+		s3Parts[i] = s3.Part{N: p.N, ETag: p.ETag, Size: p.Size}
+		size += p.Size
+	}
+	if err := c.multi(key, uploadID).Complete(s3Parts); err != nil {
+		return object{}, err
+	}
+
+	return object{
+		Name:     key,
+		Size:     size,
+		BaseURL:  c.BaseURL(),
+		Modified: time.Now(),
+	}, nil
+}
+
+// AbortUpload aborts a multipart upload to an s3 bucket and deletes its
+// parts.
+func (c *s3Provider) AbortUpload(ctx context.Context, key, uploadID string) (err error) {
+	_, span := trace.StartSpan(ctx, "s3.AbortUpload", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.AddAttributes(trace.StringAttribute("key", key))
+
+	start := time.Now()
+	defer func() {
+		observeProviderCall("s3", "abort_upload", start, err)
+		setSpanError(span, err)
+	}()
+
+	return c.multi(key, uploadID).Abort()
+}
+
 // Prefix returns the prefix in an s3 bucket.
 func (c *s3Provider) Prefix() string {
 	return c.prefix
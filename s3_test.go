@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestS3ACLs(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		acls = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		acls[r.URL.Path] = r.Header.Get("X-Amz-Acl")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	configMu.Lock()
+	uploadACL, publishACL = "private", "public-read"
+	configMu.Unlock()
+	defer func() { uploadACL, publishACL = "", "" }()
+
+	client := s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Name: "test", S3Endpoint: srv.URL})
+	p := &s3Provider{bucket: "gifs", prefix: "/", client: client, b: client.Bucket("gifs")}
+	ctx := context.Background()
+	if _, err := p.Put(ctx, "dance.gif", strings.NewReader("GIF89a"), 6, "image/gif"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(ctx, "index.html", []byte("<html>"), "text/html", "public, max-age=60"); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := acls["/gifs/dance.gif"]; got != "private" {
+		t.Errorf("upload: got ACL %q, want private", got)
+	}
+	if got := acls["/gifs/index.html"]; got != "public-read" {
+		t.Errorf("published index: got ACL %q, want public-read", got)
+	}
+}
+
+// newS3ListServer lists keys the way S3 does: a page holds at most
+// max-keys keys and common prefixes, and the next marker is only set when
+// listing with a delimiter.
+func newS3ListServer(keys []string) *httptest.Server {
+	sort.Strings(keys)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		prefix, delim, marker := q.Get("prefix"), q.Get("delimiter"), q.Get("marker")
+		max, _ := strconv.Atoi(q.Get("max-keys"))
+		if max == 0 {
+			max = 1000
+		}
+
+		resp := s3.ListResp{Name: "gifs", Prefix: prefix, Delimiter: delim, Marker: marker, MaxKeys: max}
+		var last string
+		for _, k := range keys {
+			if !strings.HasPrefix(k, prefix) || k <= marker {
+				continue
+			}
+			cp := ""
+			if i := strings.Index(k[len(prefix):], delim); delim != "" && i >= 0 {
+				cp = k[:len(prefix)+i+len(delim)]
+				if cp <= marker || cp == last {
+					continue
+				}
+			}
+			if len(resp.Contents)+len(resp.CommonPrefixes) == max {
+				resp.IsTruncated = true
+				break
+			}
+			if cp != "" {
+				resp.CommonPrefixes = append(resp.CommonPrefixes, cp)
+				last = cp
+				continue
+			}
+			resp.Contents = append(resp.Contents, s3.Key{Key: k, Size: 1})
+			last = k
+		}
+		if resp.IsTruncated && delim != "" {
+			resp.NextMarker = last
+		}
+		xml.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestS3ListPages(t *testing.T) {
+	var keys []string
+	for i := 0; i < 2500; i++ {
+		keys = append(keys, fmt.Sprintf("gifs/%04d.gif", i))
+	}
+	keys = append(keys, "gifs/reactions/dance.gif")
+	srv := newS3ListServer(keys)
+	defer srv.Close()
+
+	client := s3.New(aws.Auth{AccessKey: "key", SecretKey: "secret"}, aws.Region{Name: "test", S3Endpoint: srv.URL})
+	p := &s3Provider{bucket: "gifs", prefix: "gifs", client: client, b: client.Bucket("gifs")}
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		delimiter string
+		want      int
+	}{
+		{"", 2501},
+		{"/", 2500},
+	} {
+		files, err := p.List(ctx, "gifs/", c.delimiter, "", 1000, nil)
+		if err != nil {
+			t.Fatalf("delimiter %q: %v", c.delimiter, err)
+		}
+		if len(files) != c.want {
+			t.Errorf("delimiter %q: got %d objects, want %d", c.delimiter, len(files), c.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Namespace is the XML namespace of S3 API responses.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is the format of times in S3 API responses.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3ListBucketsResponse struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   s3Owner
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3LocationResponse struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+// s3ListResponse is the response of ListObjects and ListObjectsV2. The
+// pointer fields are only set for one of the two.
+type s3ListResponse struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Marker                *string
+	NextMarker            string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              *int
+	MaxKeys               int
+	Delimiter             string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []s3Content
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3Content struct {
+	Key          string
+	LastModified string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// s3GatewayHandler serves a read-only S3 API under prefix, with a bucket
+// for every mount holding its objects by key relative to the mount's
+// bucket prefix. It supports ListBuckets, HeadBucket, GetBucketLocation,
+// ListObjects, ListObjectsV2, GetObject and HeadObject.
+func s3GatewayHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The gateway is read-only.")
+			return
+		}
+
+		p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if p == "" {
+			s3ListBuckets(w, r)
+			return
+		}
+
+		parts := strings.SplitN(p, "/", 2)
+		m := mountNamed(parts[0])
+		if m == nil {
+			s3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+			return
+		}
+
+		if len(parts) == 2 && parts[1] != "" {
+			s3GetObject(w, r, m, parts[1])
+			return
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, ok := r.URL.Query()["location"]; ok {
+			s3WriteXML(w, http.StatusOK, s3LocationResponse{Xmlns: s3Namespace})
+			return
+		}
+		s3ListObjects(w, r, m)
+	})
+}
+
+// s3Error writes an S3 error response.
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	s3WriteXML(w, status, s3ErrorResponse{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+func s3WriteXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3ListBuckets lists the mounts as buckets.
+func s3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	resp := s3ListBucketsResponse{Xmlns: s3Namespace, Owner: s3Owner{ID: "s3server", DisplayName: "s3server"}}
+	if id := identityFrom(r.Context()); id != nil {
+		resp.Owner = s3Owner{ID: id.User, DisplayName: id.User}
+	}
+
+	now := time.Now().UTC().Format(s3TimeFormat)
+	mountsMu.RLock()
+	for _, m := range mounts {
+		resp.Buckets = append(resp.Buckets, s3Bucket{Name: m.name, CreationDate: now})
+	}
+	mountsMu.RUnlock()
+
+	s3WriteXML(w, http.StatusOK, resp)
+}
+
+// s3ListObjects lists the objects of a mount the viewer can read from its
+// listing, as ListObjectsV2 when the list-type is 2 and as ListObjects
+// otherwise.
+func s3ListObjects(w http.ResponseWriter, r *http.Request, m *mount) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+
+	maxKeys := 1000
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			s3Error(w, r, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer.")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	escape := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		escape = func(s string) string {
+			return strings.Replace(url.PathEscape(s), "%2F", "/", -1)
+		}
+	}
+
+	resp := s3ListResponse{
+		Xmlns:        s3Namespace,
+		Name:         m.name,
+		Prefix:       escape(prefix),
+		MaxKeys:      maxKeys,
+		Delimiter:    escape(delimiter),
+		EncodingType: q.Get("encoding-type"),
+	}
+
+	// keys sort after the marker, start-after or continuation token
+	var after string
+	if v2 {
+		after = q.Get("start-after")
+		resp.StartAfter = escape(after)
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				s3Error(w, r, http.StatusBadRequest, "InvalidArgument", "The continuation token is not valid.")
+				return
+			}
+			after = string(b)
+			resp.ContinuationToken = token
+		}
+	} else {
+		after = q.Get("marker")
+		marker := escape(after)
+		resp.Marker = &marker
+	}
+
+	files, _ := m.listing()
+	rules := currentAuthzRules()
+	id := identityFrom(r.Context())
+	var keys []string
+	for _, f := range files {
+		rel := m.relativeKey(f.Name)
+		if rel == "" || !strings.HasPrefix(rel, prefix) || rel <= after || !authzAllowed(rules, id, m.name, f.Name) {
+			continue
+		}
+		keys = append(keys, rel)
+	}
+	sort.Strings(keys)
+	byKey := map[string]object{}
+	for _, f := range files {
+		byKey[m.relativeKey(f.Name)] = f
+	}
+
+	var last, lastPrefix string
+	count := 0
+	for _, k := range keys {
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				cp := k[:len(prefix)+i+len(delimiter)]
+				if cp == after || cp == lastPrefix {
+					continue
+				}
+				if count == maxKeys {
+					resp.IsTruncated = true
+					break
+				}
+				resp.CommonPrefixes = append(resp.CommonPrefixes, s3CommonPrefix{Prefix: escape(cp)})
+				last, lastPrefix = cp, cp
+				count++
+				continue
+			}
+		}
+		if count == maxKeys {
+			resp.IsTruncated = true
+			break
+		}
+		f := byKey[k]
+		resp.Contents = append(resp.Contents, s3Content{
+			Key:          escape(k),
+			LastModified: f.Modified.UTC().Format(s3TimeFormat),
+			Size:         f.Size,
+			StorageClass: "STANDARD",
+		})
+		last = k
+		count++
+	}
+
+	if v2 {
+		resp.KeyCount = &count
+		if resp.IsTruncated {
+			resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if resp.IsTruncated {
+		resp.NextMarker = escape(last)
+	}
+
+	s3WriteXML(w, http.StatusOK, resp)
+}
+
+// s3GetObject serves an object of a mount, with range requests. Objects
+// are described from the listing, or opened to find out their size if
+// they were added to the bucket since it was last indexed.
+func s3GetObject(w http.ResponseWriter, r *http.Request, m *mount, rel string) {
+	key, err := m.objectKey(m.bucketKey(rel))
+	if err != nil {
+		s3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if !authzAllowed(currentAuthzRules(), identityFrom(r.Context()), m.name, key) {
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	reader, o, err := m.openObject(r.Context(), key)
+	if err != nil {
+		s3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	defer reader.Close()
+
+	setObjectHeaders(w.Header(), key, contentTypeFor(key, o.ContentType))
+	http.ServeContent(w, r, rel, o.Modified, reader)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// searchDefaultLimit and searchMaxLimit bound the results of a search.
+	searchDefaultLimit = 50
+	searchMaxLimit     = 1000
+
+	// searchMinPrefix is the shortest query token that matches the start
+	// of longer tokens.
+	searchMinPrefix = 2
+)
+
+// searchIndex maps the tokens of the objects of a listing to the objects,
+// so that searches do not have to scan every key.
+type searchIndex struct {
+	files  []object
+	tokens map[string][]int
+	// sorted holds the tokens in order, for prefix matches.
+	sorted []string
+	// tags maps lower case tags to the objects that have them.
+	tags map[string][]int
+}
+
+// newSearchIndex indexes the key names, the path segments, the content
+// types and the descriptions of the files.
+func newSearchIndex(files []object) *searchIndex {
+	idx := &searchIndex{files: files, tokens: map[string][]int{}, tags: map[string][]int{}}
+	for i, f := range files {
+		for _, t := range f.Tags {
+			t = strings.ToLower(t)
+			idx.tags[t] = append(idx.tags[t], i)
+		}
+
+		seen := map[string]bool{}
+		for _, t := range searchTokens(searchText(f)...) {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			idx.tokens[t] = append(idx.tokens[t], i)
+		}
+	}
+	for t := range idx.tokens {
+		idx.sorted = append(idx.sorted, t)
+	}
+	sort.Strings(idx.sorted)
+	return idx
+}
+
+// searchText returns the text of an object that is searched.
+func searchText(o object) []string {
+	text := strings.Split(o.Name, "/")
+	text = append(text, strings.TrimPrefix(path.Ext(o.Name), "."), o.ContentType, o.Title, o.Description)
+	return append(text, o.Tags...)
+}
+
+// searchTokens splits text into lower case words of letters and digits.
+func searchTokens(text ...string) []string {
+	var tokens []string
+	for _, s := range text {
+		tokens = append(tokens, strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	return tokens
+}
+
+// searchResult is a matching object and how well it matches.
+type searchResult struct {
+	object
+	score int
+}
+
+// search returns the objects that have all the tags and match every token
+// of the query, best matches first. A query token matches a token that is
+// equal to it, that starts with it, or that is a typo or two away from it,
+// in that order of preference. Words of the query like tag:<tag> are
+// taken as tags.
+func (idx *searchIndex) search(query string, tags ...string) []searchResult {
+	var words []string
+	for _, w := range strings.Fields(query) {
+		if t := strings.TrimPrefix(w, "tag:"); t != w {
+			tags = append(tags, t)
+			continue
+		}
+		words = append(words, w)
+	}
+	terms := searchTokens(words...)
+	if len(terms) == 0 && len(tags) == 0 || idx == nil {
+		return nil
+	}
+
+	// scores is nil until the first tag or term narrows the objects down
+	var scores map[int]int
+	for _, tag := range tags {
+		has := map[int]int{}
+		for _, i := range idx.tags[strings.ToLower(tag)] {
+			has[i] = scores[i]
+		}
+		if scores != nil {
+			for i := range has {
+				if _, ok := scores[i]; !ok {
+					delete(has, i)
+				}
+			}
+		}
+		scores = has
+	}
+
+	for _, term := range terms {
+		best := map[int]int{}
+		match := func(t string, score int) {
+			for _, i := range idx.tokens[t] {
+				if score > best[i] {
+					best[i] = score
+				}
+			}
+		}
+
+		match(term, 3)
+		if len([]rune(term)) >= searchMinPrefix {
+			for i := sort.SearchStrings(idx.sorted, term); i < len(idx.sorted) && strings.HasPrefix(idx.sorted[i], term); i++ {
+				if idx.sorted[i] != term {
+					match(idx.sorted[i], 2)
+				}
+			}
+		}
+		if max := searchTypos(term); max > 0 {
+			for _, t := range idx.sorted {
+				if t != term && withinDistance(term, t, max) {
+					match(t, 1)
+				}
+			}
+		}
+
+		// every term has to match
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for i, s := range scores {
+			if best[i] == 0 {
+				delete(scores, i)
+				continue
+			}
+			scores[i] = s + best[i]
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for i, s := range scores {
+		results = append(results, searchResult{object: idx.files[i], score: s})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// searchTypos returns how many edits a query token may be away from a
+// token and still match it.
+func searchTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	}
+	return 2
+}
+
+// withinDistance returns whether the Levenshtein distance between a and b
+// is at most max.
+func withinDistance(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return false
+	}
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < rowMin {
+				rowMin = cur[j]
+			}
+		}
+		if rowMin > max {
+			return false
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)] <= max
+}
+
+func minInt(n int, rest ...int) int {
+	for _, r := range rest {
+		if r < n {
+			n = r
+		}
+	}
+	return n
+}
+
+// searchResponse is the response of the search API.
+type searchResponse struct {
+	Query   string      `json:"query"`
+	Total   int         `json:"total"`
+	Results []apiObject `json:"results"`
+}
+
+// searchHandler serves /api/v1/search?q=<query>, searching the objects of
+// a mount the viewer can read. The tag parameters keep the objects with
+// all of the tags, and the limit parameter caps the results.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		apiError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	m, err := apiMount(r, q.Get("mount"))
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+
+	limit := searchDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			apiError(w, http.StatusBadRequest, errors.New("limit must be a positive integer"))
+			return
+		}
+		if n < searchMaxLimit {
+			limit = n
+		} else {
+			limit = searchMaxLimit
+		}
+	}
+
+	m.mu.RLock()
+	idx := m.search
+	m.mu.RUnlock()
+
+	rules := currentAuthzRules()
+	id := identityFrom(r.Context())
+	resp := searchResponse{Query: q.Get("q"), Results: []apiObject{}}
+	for _, res := range idx.search(resp.Query, q["tag"]...) {
+		if !authzAllowed(rules, id, m.name, res.Name) {
+			continue
+		}
+		resp.Total++
+		if len(resp.Results) == limit {
+			continue
+		}
+
+		resp.Results = append(resp.Results, apiObject{
+			Mount:       m.name,
+			Name:        res.Name,
+			Size:        res.Size,
+			ContentType: contentTypeFor(res.Name, res.ContentType),
+			URL:         m.objectURL(r, res.object),
+			Title:       res.Title,
+			Description: res.Description,
+			Tags:        res.Tags,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
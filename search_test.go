@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithinDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		max  int
+		want bool
+	}{
+		{"dance", "dance", 0, true},
+		{"dance", "danse", 0, false},
+		{"dance", "danse", 1, true},
+		{"dance", "dancer", 1, true},
+		{"dance", "dancers", 1, false},
+		{"kitten", "sitting", 2, false},
+		{"kitten", "sitting", 3, true},
+		{"ab", "ba", 1, false},
+		{"ab", "ba", 2, true},
+		{"", "abc", 2, false},
+		{"", "abc", 3, true},
+		{"café", "cafe", 1, true},
+		{"naïve", "naive", 0, false},
+	} {
+		if got := withinDistance(c.a, c.b, c.max); got != c.want {
+			t.Errorf("withinDistance(%q, %q, %d): got %t, want %t", c.a, c.b, c.max, got, c.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	idx := newSearchIndex([]object{
+		{Name: "reactions/dance.gif", ContentType: "image/gif"},
+		{Name: "reactions/facepalm.gif", ContentType: "image/gif", Title: "Face palm", Tags: []string{"Annoyed"}},
+		{Name: "cats/dancing-cat.mp4", Tags: []string{"cat", "happy"}},
+		{Name: "misc/dancer.png"},
+		{Name: "docs/readme.txt", Description: "How the gifs are sorted"},
+	})
+
+	for _, c := range []struct {
+		query string
+		tags  []string
+		want  string
+	}{
+		// exact matches rank above prefix matches
+		{"dance", nil, "reactions/dance.gif,misc/dancer.png"},
+		{"danc", nil, "cats/dancing-cat.mp4,misc/dancer.png,reactions/dance.gif"},
+		// every term has to match
+		{"gif reactions", nil, "reactions/dance.gif,reactions/facepalm.gif"},
+		{"dance txt", nil, ""},
+		// typos
+		{"facepam", nil, "reactions/facepalm.gif"},
+		{"fcae", nil, ""},
+		// descriptions and titles
+		{"sorted", nil, "docs/readme.txt"},
+		{"palm", nil, "reactions/facepalm.gif"},
+		// tags, in the query or given, ignoring case
+		{"tag:cat", nil, "cats/dancing-cat.mp4"},
+		{"", []string{"happy"}, "cats/dancing-cat.mp4"},
+		{"tag:annoyed palm", nil, "reactions/facepalm.gif"},
+		{"tag:cat dance", nil, ""},
+		{"tag:cat", []string{"annoyed"}, ""},
+		{"", nil, ""},
+		{"  ---  ", nil, ""},
+	} {
+		var names []string
+		for _, r := range idx.search(c.query, c.tags...) {
+			names = append(names, r.Name)
+		}
+		if got := strings.Join(names, ","); got != c.want {
+			t.Errorf("search(%q, %v): got %s, want %s", c.query, c.tags, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessKeyConfig is an AWS style access key pair and the identity it
+// grants, for S3 clients.
+type accessKeyConfig struct {
+	AccessKey string   `yaml:"access_key"`
+	SecretKey string   `yaml:"secret_key"`
+	User      string   `yaml:"user"`
+	Groups    []string `yaml:"groups"`
+}
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4MaxSkew   = 15 * time.Minute
+	sigV4TimeFmt   = "20060102T150405Z"
+	// sigV4MaxExpires is the longest a presigned URL can be valid for, as
+	// with S3.
+	sigV4MaxExpires = 7 * 24 * time.Hour
+	// sigV4MaxPayload is the largest body that is read to check its hash.
+	sigV4MaxPayload = 1 << 20
+	// unsignedPayload stands in for the payload hash of requests that do
+	// not sign their body.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sigV4Auth checks AWS signature version 4 signed requests, in the
+// Authorization header or presigned in the query, against static access
+// keys. Access keys are only accepted under the S3 gateway's path, and
+// signed payload hashes are checked against the body.
+type sigV4Auth struct {
+	prefix string
+	keys   map[string]accessKeyConfig
+}
+
+// newSigV4Auth returns the access keys checker for the S3 gateway served
+// at gatewayPath.
+func newSigV4Auth(keys []accessKeyConfig, gatewayPath string) (*sigV4Auth, error) {
+	a := &sigV4Auth{
+		prefix: "/" + strings.Trim(gatewayPath, "/") + "/",
+		keys:   map[string]accessKeyConfig{},
+	}
+	for i, k := range keys {
+		if k.AccessKey == "" || k.SecretKey == "" || k.User == "" {
+			return nil, fmt.Errorf("auth access key %d needs an access key, a secret key and a user", i)
+		}
+		a.keys[k.AccessKey] = k
+	}
+	return a, nil
+}
+
+func (a *sigV4Auth) authenticate(r *http.Request) (*identity, error) {
+	q := r.URL.Query()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ") && q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errNoCredentials
+	}
+	if !strings.HasPrefix(r.URL.Path, a.prefix) {
+		return nil, fmt.Errorf("access keys are only accepted under %s", a.prefix)
+	}
+
+	var credential, signedHeaders, signature, amzDate, payloadHash string
+	expires := sigV4MaxSkew
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, sigV4Algorithm+" ") {
+		for _, field := range strings.Split(strings.TrimPrefix(h, sigV4Algorithm+" "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = emptySHA256
+		}
+	} else if q.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		payloadHash = unsignedPayload
+		secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || secs <= 0 {
+			return nil, errors.New("invalid X-Amz-Expires")
+		}
+		expires = time.Duration(secs) * time.Second
+		if expires > sigV4MaxExpires {
+			return nil, fmt.Errorf("X-Amz-Expires must be at most %d", int(sigV4MaxExpires.Seconds()))
+		}
+	}
+
+	// the credential is <key>/<date>/<region>/<service>/aws4_request
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || signedHeaders == "" || signature == "" {
+		return nil, errors.New("malformed signature")
+	}
+	key, ok := a.keys[scope[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown access key %q", scope[0])
+	}
+	parts := strings.Split(scope[1], "/")
+	if len(parts) != 4 || parts[3] != "aws4_request" || !strings.HasPrefix(amzDate, parts[0]) {
+		return nil, errors.New("malformed credential scope")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		sigV4Escape(r.URL.Path, false),
+		sigV4Query(q),
+		sigV4Headers(r, signedHeaders),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{sigV4Algorithm, amzDate, scope[1], hex.EncodeToString(sum[:])}, "\n")
+
+	signingKey := []byte("AWS4" + key.SecretKey)
+	for _, p := range parts {
+		signingKey = hmacSHA256(signingKey, p)
+	}
+	expected := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, fmt.Errorf("signature mismatch for access key %q", scope[0])
+	}
+
+	t, err := time.Parse(sigV4TimeFmt, amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Amz-Date %q", amzDate)
+	}
+	if now := time.Now(); t.After(now.Add(sigV4MaxSkew)) || now.After(t.Add(expires)) {
+		return nil, errors.New("request signature expired")
+	}
+
+	if err := checkPayload(r, payloadHash); err != nil {
+		return nil, err
+	}
+
+	return &identity{User: key.User, Groups: key.Groups}, nil
+}
+
+// checkPayload checks the body of r against the signed payload hash. Only
+// reads, which have no body, may leave the payload unsigned.
+func checkPayload(r *http.Request, payloadHash string) error {
+	if payloadHash == unsignedPayload {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			return fmt.Errorf("%s requests must sign their payload", r.Method)
+		}
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, sigV4MaxPayload+1))
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("reading the payload failed: %v", err)
+		}
+		if len(body) > sigV4MaxPayload {
+			return errors.New("payload too large to check its signature")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sum := sha256.Sum256(body)
+	if !hmac.Equal([]byte(hex.EncodeToString(sum[:])), []byte(payloadHash)) {
+		return errors.New("payload does not match its signed hash")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sigV4Escape escapes s the way AWS does for signing, keeping slashes
+// unless encodeSlash is set.
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sigV4Query returns the canonical query string, without the signature.
+func sigV4Query(q url.Values) string {
+	var pairs [][2]string
+	for k, vs := range q {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, [2]string{sigV4Escape(k, true), sigV4Escape(v, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	s := make([]string, len(pairs))
+	for i, p := range pairs {
+		s[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(s, "&")
+}
+
+// sigV4Headers returns the canonical headers for the signed header names.
+func sigV4Headers(r *http.Request, signedHeaders string) string {
+	var b strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			var values []string
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		b.WriteString(name + ":" + value + "\n")
+	}
+	return b.String()
+}
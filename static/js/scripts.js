@@ -19,20 +19,32 @@ function prettyDate(time){
 		day_diff > 31 && Math.round(day_diff / 31) + " months ago";
 }
 
-// search function
+// search function, rows with a tag for tag:<tag>
 function search(search_val){
 	var suche = search_val.toLowerCase();
+	var by_tag = suche.indexOf('tag:') === 0;
+	if (by_tag) {
+		suche = ',' + suche.substring(4) + ',';
+	}
 	var table = document.getElementById("directory");
 	var cellNr = 1;
 	var ele;
 	for (var r = 1; r < table.rows.length; r++){
 		ele = table.rows[r].cells[cellNr].innerHTML.replace(/<[^>]+>/g,"");
+		if (by_tag) {
+			ele = ',' + (table.rows[r].getAttribute('data-tags') || '');
+		}
 		if (ele.toLowerCase().indexOf(suche)>=0 ) {
 			table.rows[r].style.display = '';
 		} else {
 			table.rows[r].style.display = 'none';
 		}
 	}
+
+	Array.prototype.forEach.call(document.querySelectorAll('div.gallery figure'), function(figure){
+		var text = by_tag ? ',' + figure.getAttribute('data-tags') : figure.getAttribute('data-name');
+		figure.style.display = text.toLowerCase().indexOf(suche) >= 0 ? '' : 'none';
+	});
 }
 
 
@@ -59,6 +71,9 @@ if (el.textContent == 'Parent Directory'){
 var cells = document.querySelectorAll('td a');
 Array.prototype.forEach.call(cells, function(item, index){
 	var link = item.getAttribute('href');
+	if (link === null || item.className === 'view') {
+		return;
+	}
 	link = link.replace('.html', '');
 	item.setAttribute('href', link);
 });
@@ -70,6 +85,11 @@ our_table.setAttribute('id', 'directory');
 var search_input = document.querySelectorAll('input[name="filter"]')[0];
 var clear_button = document.querySelectorAll('a.clear')[0];
 
+// links from object pages filter by a tag
+if (location.hash.indexOf('#tag:') === 0) {
+	search_input.value = decodeURIComponent(location.hash.substring(1));
+}
+
 if (search_input.value !== ''){
 	search(search_input.value);
 }
@@ -82,10 +102,152 @@ search_input.addEventListener('keyup', function(e){
 search_input.addEventListener('keypress', function(e){
 	if ( e.which == 13 ) {
 		e.preventDefault();
+		searchServer(search_input.value);
 	}
 });
 
 clear_button.addEventListener('click', function(e){
 	search_input.value = '';
 	search('');
-});
\ No newline at end of file
+	searchServer('');
+});
+
+// clicking a tag shows the objects with it
+document.addEventListener('click', function(e){
+	if (e.target.className !== 'tag') {
+		return;
+	}
+	search_input.value = 'tag:' + e.target.textContent;
+	search(search_input.value);
+	searchServer(search_input.value);
+});
+
+// human readable size, like the sizes on the index
+function humanSize(n){
+	var units = ['B', 'kB', 'MB', 'GB', 'TB', 'PB'];
+	var i = 0;
+	while (n >= 1000 && i < units.length - 1) {
+		n /= 1000;
+		i++;
+	}
+	return parseFloat(n.toPrecision(4)) + units[i];
+}
+
+// server side search, over every object of the mount rather than the rows
+// on the page. Static copies of the index have no API and keep the filter.
+var search_form = document.querySelectorAll('form.search')[0];
+var results = document.querySelectorAll('div.results')[0];
+
+function searchServer(q){
+	var table = document.getElementById('results');
+	if (q === '') {
+		results.hidden = true;
+		showView(currentView());
+		return;
+	}
+
+	var req = new XMLHttpRequest();
+	req.open('GET', '/api/v1/search?limit=200&mount=' + encodeURIComponent(search_form.getAttribute('data-mount')) + '&q=' + encodeURIComponent(q));
+	req.onload = function(){
+		if (req.status != 200) {
+			return;
+		}
+		var resp = JSON.parse(req.responseText);
+		table.innerHTML = '';
+		var head = table.insertRow();
+		head.innerHTML = '<th>' + resp.total + ' results</th><th>Name</th><th>Size</th>';
+		resp.results.forEach(function(o){
+			var row = table.insertRow();
+			var ext = o.name.split('.').pop();
+			var link = document.createElement('a');
+			link.href = o.url;
+			link.textContent = o.name;
+			row.insertCell().innerHTML = '<img src="/icons/' + encodeURIComponent(ext) + '.png" alt="[IMG]" />';
+			var name = row.insertCell();
+			name.appendChild(link);
+			if (o.description) {
+				link.title = o.description;
+			}
+			if (o.title) {
+				var title = document.createElement('span');
+				title.className = 'title';
+				title.textContent = ' ' + o.title;
+				name.appendChild(title);
+			}
+			(o.tags || []).forEach(function(t){
+				var tag = document.createElement('a');
+				tag.className = 'tag';
+				tag.textContent = t;
+				name.appendChild(document.createTextNode(' '));
+				name.appendChild(tag);
+			});
+			var size = row.insertCell();
+			size.align = 'right';
+			size.textContent = humanSize(o.size);
+		});
+		results.hidden = false;
+		our_table.parentNode.hidden = true;
+		if (gallery) {
+			gallery.hidden = true;
+		}
+	};
+	req.send();
+}
+
+// rename and delete controls
+Array.prototype.forEach.call(document.querySelectorAll('form.rename'), function(form){
+	form.addEventListener('submit', function(e){
+		var destination = form.querySelectorAll('input[name="destination"]')[0];
+		var name = prompt('Rename to', destination.value);
+		if (name === null || name === '' || name === destination.value) {
+			e.preventDefault();
+			return;
+		}
+		destination.value = name;
+	});
+});
+
+Array.prototype.forEach.call(document.querySelectorAll('form.delete'), function(form){
+	form.addEventListener('submit', function(e){
+		var key = form.querySelectorAll('input[name="key"]')[0].value;
+		if (!confirm('Delete ' + key + '?')) {
+			e.preventDefault();
+		}
+	});
+});
+
+// table and gallery views, remembered between pages
+var gallery = document.querySelectorAll('div.gallery')[0];
+
+function currentView(){
+	try {
+		return localStorage.getItem('view') || 'table';
+	} catch (e) {
+		return 'table';
+	}
+}
+
+function showView(view){
+	if (!gallery) {
+		our_table.parentNode.hidden = false;
+		return;
+	}
+	gallery.hidden = view !== 'gallery';
+	our_table.parentNode.hidden = view === 'gallery';
+	Array.prototype.forEach.call(document.querySelectorAll('p.views a'), function(a){
+		a.className = a.getAttribute('data-view') === view ? 'active' : '';
+	});
+}
+
+Array.prototype.forEach.call(document.querySelectorAll('p.views a'), function(a){
+	a.addEventListener('click', function(e){
+		var view = a.getAttribute('data-view');
+		try {
+			localStorage.setItem('view', view);
+		} catch (err) {}
+		results.hidden = true;
+		showView(view);
+	});
+});
+
+showView(currentView());
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jessfraz/s3server/version"
+)
+
+// indexStatus holds the outcome of the most recent index runs.
+type indexStatus struct {
+	mu sync.RWMutex
+
+	lastAttempt  time.Time
+	lastSuccess  time.Time
+	lastDuration time.Duration
+	objects      int
+	lastError    string
+}
+
+// start records the beginning of an index run.
+func (s *indexStatus) start() time.Time {
+	now := time.Now()
+
+	s.mu.Lock()
+	s.lastAttempt = now
+	s.mu.Unlock()
+
+	return now
+}
+
+// finish records the outcome of an index run that began at start.
+func (s *indexStatus) finish(start time.Time, objects int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastDuration = time.Since(start)
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+
+	s.lastSuccess = time.Now()
+	s.objects = objects
+	s.lastError = ""
+}
+
+// ready returns true if an index has been built and the provider
+// was reachable within the given window.
+func (s *indexStatus) ready(window time.Duration) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.lastSuccess.IsZero() {
+		return false
+	}
+	return time.Since(s.lastSuccess) <= window
+}
+
+type statusResponse struct {
+	Version   string        `json:"version"`
+	GitCommit string        `json:"gitCommit"`
+	Mounts    []mountStatus `json:"mounts"`
+}
+
+type mountStatus struct {
+	Name         string    `json:"name"`
+	Path         string    `json:"path"`
+	Provider     string    `json:"provider"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+	LastIndexed  time.Time `json:"lastIndexed"`
+	LastDuration string    `json:"lastDuration"`
+	Objects      int       `json:"objects"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether every mount has built an index and its
+// provider has been reachable within the last readyIntervals intervals.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	n := time.Duration(readyIntervals)
+	configMu.RUnlock()
+
+	ready := true
+	mountsMu.RLock()
+	for _, m := range mounts {
+		if !m.status.ready(n * m.interval) {
+			ready = false
+		}
+	}
+	mountsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// statusHandler returns the index status of every mount as JSON.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{
+		Version:   version.VERSION,
+		GitCommit: version.GITCOMMIT,
+		Mounts:    []mountStatus{},
+	}
+
+	mountsMu.RLock()
+	for _, m := range mounts {
+		m.status.mu.RLock()
+		resp.Mounts = append(resp.Mounts, mountStatus{
+			Name:         m.name,
+			Path:         m.path,
+			Provider:     m.provider,
+			LastAttempt:  m.status.lastAttempt,
+			LastIndexed:  m.status.lastSuccess,
+			LastDuration: m.status.lastDuration.String(),
+			Objects:      m.status.objects,
+			LastError:    m.status.lastError,
+		})
+		m.status.mu.RUnlock()
+	}
+	mountsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
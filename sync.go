@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const syncHelp = `Mirror the objects under a prefix of a mount to a local directory.`
+
+// syncCommand downloads the objects under a prefix that are missing or
+// changed in a local directory, and optionally deletes the local files
+// that are not in the bucket.
+type syncCommand struct {
+	mount    string
+	match    string
+	parallel int
+	delete   bool
+	dryRun   bool
+}
+
+func (cmd *syncCommand) Name() string      { return "sync" }
+func (cmd *syncCommand) Args() string      { return "[prefix] <dir>" }
+func (cmd *syncCommand) ShortHelp() string { return syncHelp }
+func (cmd *syncCommand) LongHelp() string  { return syncHelp }
+func (cmd *syncCommand) Hidden() bool      { return false }
+
+func (cmd *syncCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.mount, "mount", "", "name of the mount to sync, defaults to the first one")
+	fs.StringVar(&cmd.match, "match", "", "glob the object names must match, against the whole key if it has a slash (ex. *.gif)")
+	fs.IntVar(&cmd.parallel, "parallel", 8, "number of objects to download at once")
+	fs.BoolVar(&cmd.delete, "delete", false, "delete local files that are not in the bucket")
+	fs.BoolVar(&cmd.dryRun, "dry-run", false, "print what would change without changing anything")
+}
+
+func (cmd *syncCommand) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("sync needs a directory, and optionally a prefix before it")
+	}
+	if cmd.parallel < 1 {
+		return fmt.Errorf("parallel must be at least 1")
+	}
+	dir := args[len(args)-1]
+
+	m, prefix, err := inspectTarget(cmd.mount, args[:len(args)-1])
+	if err != nil {
+		return err
+	}
+	files, err := inspectList(ctx, m, prefix, cmd.match)
+	if err != nil {
+		return err
+	}
+
+	// objects are named relative to the prefix in the directory
+	wanted := map[string]bool{}
+	var changed []object
+	for _, f := range files {
+		if _, err := m.objectKey(m.bucketKey(f.Name)); err != nil {
+			logrus.Warnf("skipping %s: %v", f.Name, err)
+			continue
+		}
+		rel := f.Name[len(prefix):]
+		local := filepath.Join(dir, filepath.FromSlash(rel))
+		wanted[local] = true
+
+		ok, err := syncUpToDate(local, f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			changed = append(changed, f)
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+	)
+	jobs := make(chan object)
+	for i := 0; i < cmd.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				local := filepath.Join(dir, filepath.FromSlash(f.Name[len(prefix):]))
+				if cmd.dryRun {
+					logrus.Infof("would download %s to %s", f.Name, local)
+					continue
+				}
+				if err := syncDownload(ctx, m, f, local); err != nil {
+					logrus.Warnf("downloading %s failed: %v", f.Name, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+					continue
+				}
+				logrus.Infof("downloaded %s to %s", f.Name, local)
+			}
+		}()
+	}
+	for _, f := range changed {
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+
+	deleted := 0
+	if cmd.delete {
+		if deleted, err = cmd.deleteExtraneous(dir, wanted); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("synced %d objects to %s: %d downloaded, %d up to date, %d deleted", len(wanted), dir, len(changed)-failed, len(wanted)-len(changed), deleted)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(changed))
+	}
+	return nil
+}
+
+// deleteExtraneous deletes the files in dir that are not wanted, only
+// looking at the ones matching the glob if there is one, and returns how
+// many there were.
+func (cmd *syncCommand) deleteExtraneous(dir string, wanted map[string]bool) (int, error) {
+	n := 0
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || wanted[p] {
+			return nil
+		}
+		if cmd.match != "" {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			name := path.Base(filepath.ToSlash(rel))
+			if strings.Contains(cmd.match, "/") {
+				name = filepath.ToSlash(rel)
+			}
+			if ok, _ := path.Match(cmd.match, name); !ok {
+				return nil
+			}
+		}
+
+		n++
+		if cmd.dryRun {
+			logrus.Infof("would delete %s", p)
+			return nil
+		}
+		logrus.Infof("deleting %s", p)
+		return os.Remove(p)
+	})
+	return n, err
+}
+
+// syncUpToDate returns whether the local file has the size and the
+// modification time of the object, or failing that its MD5.
+func syncUpToDate(local string, o object) (bool, error) {
+	info, err := os.Stat(local)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() || info.Size() != o.Size {
+		return false, nil
+	}
+	if !o.Modified.IsZero() && info.ModTime().Equal(o.Modified) {
+		return true, nil
+	}
+
+	// multipart s3 etags are not the MD5 of the contents
+	if len(o.ETag) != md5.Size*2 {
+		return false, nil
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, fmt.Errorf("hashing %s failed: %v", local, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(o.ETag), nil
+}
+
+// syncDownload downloads the object to a temporary file next to local and
+// renames it into place with the object's modification time.
+func syncDownload(ctx context.Context, m *mount, o object, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+
+	body, _, err := m.p.Open(ctx, m.bucketKey(o.Name))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := ioutil.TempFile(filepath.Dir(local), ".s3server-sync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	n, err := io.Copy(f, body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if n != o.Size {
+		return fmt.Errorf("got %d bytes, expected %d", n, o.Size)
+	}
+	if !o.Modified.IsZero() {
+		if err := os.Chtimes(f.Name(), o.Modified, o.Modified); err != nil {
+			return err
+		}
+	}
+	return os.Rename(f.Name(), local)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, "dance.gif")
+	if err := ioutil.WriteFile(local, []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Unix(1500000000, 0)
+	if err := os.Chtimes(local, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum([]byte("GIF89a"))
+	etag := hex.EncodeToString(sum[:])
+	later := modified.Add(time.Hour)
+
+	for _, c := range []struct {
+		name  string
+		local string
+		o     object
+		want  bool
+	}{
+		{"missing", filepath.Join(dir, "missing.gif"), object{Size: 6, Modified: modified}, false},
+		{"folder", dir, object{Size: 6, Modified: modified}, false},
+		{"same size and time", local, object{Size: 6, Modified: modified}, true},
+		{"other size", local, object{Size: 7, Modified: modified}, false},
+		{"other time", local, object{Size: 6, Modified: later}, false},
+		{"other time, same MD5", local, object{Size: 6, Modified: later, ETag: strings.ToUpper(etag)}, true},
+		{"other time, other MD5", local, object{Size: 6, Modified: later, ETag: strings.Repeat("0", 32)}, false},
+		{"multipart etag", local, object{Size: 6, ETag: etag + "-2"}, false},
+	} {
+		got, err := syncUpToDate(c.local, c.o)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSyncDeleteExtraneous(t *testing.T) {
+	for _, c := range []struct {
+		match  string
+		wanted []string
+		left   string
+	}{
+		{"", []string{"dance.gif"}, "dance.gif"},
+		{"*.gif", []string{"dance.gif"}, "dance.gif,notes.txt,reactions/todo.txt"},
+		{"reactions/*.txt", nil, "dance.gif,notes.txt,reactions/wave.gif"},
+	} {
+		dir, err := ioutil.TempDir("", "s3server-sync")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for _, name := range []string{"dance.gif", "notes.txt", "reactions/wave.gif", "reactions/todo.txt"} {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// files that do not match the glob are left alone
+		wanted := map[string]bool{}
+		for _, name := range c.wanted {
+			wanted[filepath.Join(dir, filepath.FromSlash(name))] = true
+		}
+		cmd := &syncCommand{match: c.match}
+		n, err := cmd.deleteExtraneous(dir, wanted)
+		if err != nil {
+			t.Fatalf("match %q: %v", c.match, err)
+		}
+
+		var left []string
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(dir, p)
+				left = append(left, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		sort.Strings(left)
+		if got := strings.Join(left, ","); got != c.left || n != 4-len(left) {
+			t.Errorf("match %q: deleted %d, left %s, want %s", c.match, n, got, c.left)
+		}
+	}
+
+	// a dry run deletes nothing
+	dir, err := ioutil.TempDir("", "s3server-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "dance.gif")
+	if err := ioutil.WriteFile(p, []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &syncCommand{dryRun: true}
+	if n, err := cmd.deleteExtraneous(dir, nil); err != nil || n != 1 {
+		t.Errorf("dry run: got %d, %v, want 1", n, err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("dry run deleted the file: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif" // register the decoders for thumbnails
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxThumbnailSource is the largest object a thumbnail is made of.
+	maxThumbnailSource = 32 << 20
+	// maxThumbnailPixels is the largest image a thumbnail is made of, so
+	// that small files of huge images are not decoded. Decoded it takes up
+	// to 64MB.
+	maxThumbnailPixels = 16 << 20
+	// thumbnailParallel is how many thumbnails are made at once.
+	thumbnailParallel = 2
+	// thumbnailQuality is the JPEG quality of thumbnails.
+	thumbnailQuality = 80
+)
+
+// thumbnailExts are the extensions of the objects that get thumbnails.
+var thumbnailExts = map[string]bool{
+	".gif":  true,
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+}
+
+// thumbnailName returns the name of the thumbnail of an object, by its
+// ETag so that copies share a thumbnail, or else by key and version.
+func thumbnailName(o object) string {
+	if len(o.ETag) == 32 {
+		return strings.ToLower(o.ETag)
+	}
+	sum := sha256.Sum256([]byte(o.Name + "\x00" + objectVersion(o)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// thumbnailPath returns where the thumbnail with the name is kept.
+func thumbnailPath(name string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return filepath.Join(thumbnailDir, name+".jpg")
+}
+
+// thumbnail makes the missing thumbnails of the images in files and sets
+// their names. Objects whose thumbnail fails are left without one, and are
+// not tried again until they change.
+func (m *mount) thumbnail(ctx context.Context, files []object) {
+	configMu.RLock()
+	dir, size := thumbnailDir, thumbnailSize
+	configMu.RUnlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.Warnf("creating thumbnail directory %s failed: %v", dir, err)
+		return
+	}
+
+	m.thumbnailMu.Lock()
+	defer m.thumbnailMu.Unlock()
+	failed := map[string]bool{}
+
+	var todo []int
+	for i, f := range files {
+		if !thumbnailExts[strings.ToLower(path.Ext(f.Name))] || f.Size == 0 || f.Size > maxThumbnailSource {
+			continue
+		}
+		name := thumbnailName(f)
+		if m.thumbnailFailed[name] {
+			failed[name] = true
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, name+".jpg"))
+		observeCache("thumbnails", err == nil)
+		if err == nil {
+			files[i].Thumbnail = name
+			continue
+		}
+		todo = append(todo, i)
+	}
+
+	var mu sync.Mutex
+	forEachParallel(len(todo), thumbnailParallel, func(j int) {
+		f := &files[todo[j]]
+		name := thumbnailName(*f)
+		if err := m.makeThumbnail(ctx, f.Name, filepath.Join(dir, name+".jpg"), size); err != nil {
+			logrus.Warnf("making the thumbnail of %s in mount %s failed: %v", f.Name, m.name, err)
+			if _, ok := err.(badImageError); ok {
+				mu.Lock()
+				failed[name] = true
+				mu.Unlock()
+			}
+			return
+		}
+		f.Thumbnail = name
+	})
+	m.thumbnailFailed = failed
+}
+
+// badImageError is returned for objects that cannot be made into a
+// thumbnail, rather than failing to be read.
+type badImageError struct {
+	error
+}
+
+// makeThumbnail decodes the object, the first frame of a gif, and writes
+// it scaled to fit in a size by size square as a JPEG to dst.
+func (m *mount) makeThumbnail(ctx context.Context, key, dst string, size int) error {
+	body, _, err := m.p.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxThumbnailSource))
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return badImageError{fmt.Errorf("decoding image config failed: %v", err)}
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return badImageError{fmt.Errorf("image is %dx%d, too large for a thumbnail", cfg.Width, cfg.Height)}
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return badImageError{fmt.Errorf("decoding image failed: %v", err)}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".thumbnail")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := jpeg.Encode(f, scaleDown(img, size), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		f.Close()
+		return fmt.Errorf("encoding thumbnail failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+// scaleDown returns the image on a white background, scaled to fit in a
+// size by size square by averaging up to 4 by 4 of the pixels that make up
+// each pixel. Smaller images keep their size. The pixels are read from img
+// as they are needed, so no full size copy of it is made.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	sb := img.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, sh*size/sw
+		} else {
+			dw, dh = sw*size/sh, size
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		ystep := (y1 - y0 + 3) / 4
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			xstep := (x1 - x0 + 3) / 4
+
+			// colors are premultiplied, so the background shows through
+			// as much as they are transparent
+			var r, g, b, n uint32
+			for sy := y0; sy < y1; sy += ystep {
+				for sx := x0; sx < x1; sx += xstep {
+					cr, cg, cb, ca := img.At(sb.Min.X+sx, sb.Min.Y+sy).RGBA()
+					r += cr + 0xffff - ca
+					g += cg + 0xffff - ca
+					b += cb + 0xffff - ca
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// thumbnailHandler serves /-/thumbnails/<name>.jpg to the viewers that can
+// read the object it was made of.
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/-/thumbnails/"), ".jpg")
+	if _, err := hex.DecodeString(name); err != nil || name == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	rules := currentAuthzRules()
+	id := identityFrom(r.Context())
+	allowed := false
+	mountsMu.RLock()
+	for _, m := range mounts {
+		m.mu.RLock()
+		for _, key := range m.thumbnails[name] {
+			if authzAllowed(rules, id, m.name, key) {
+				allowed = true
+				break
+			}
+		}
+		m.mu.RUnlock()
+	}
+	mountsMu.RUnlock()
+	if !allowed {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if len(rules) > 0 {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	http.ServeFile(w, r, thumbnailPath(name))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScaleDown(t *testing.T) {
+	// red on the left, transparent on the right
+	wide := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			wide.Set(x, y, color.NRGBA{R: 0xff, A: 0xff})
+		}
+	}
+	tall := image.NewGray(image.Rect(0, 0, 100, 1000))
+	offset := image.NewRGBA(image.Rect(50, 50, 60, 60))
+
+	for _, c := range []struct {
+		name   string
+		img    image.Image
+		w, h   int
+		points map[image.Point]color.RGBA
+	}{
+		{"wide", wide, 200, 100, map[image.Point]color.RGBA{
+			{10, 50}:  {R: 0xff, A: 0xff},
+			{150, 50}: {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		}},
+		{"tall", tall, 20, 200, map[image.Point]color.RGBA{
+			{10, 100}: {A: 0xff},
+		}},
+		{"small", offset, 10, 10, map[image.Point]color.RGBA{
+			{0, 0}: {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		}},
+	} {
+		got := scaleDown(c.img, 200)
+		if b := got.Bounds(); b.Dx() != c.w || b.Dy() != c.h {
+			t.Errorf("%s: got %dx%d, want %dx%d", c.name, b.Dx(), b.Dy(), c.w, c.h)
+			continue
+		}
+		for p, want := range c.points {
+			if got := got.RGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: at %v got %v, want %v", c.name, p, got, want)
+			}
+		}
+	}
+}
+
+func TestThumbnailHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-thumbnails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"0a", "0b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".jpg"), []byte("JPEG"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &mount{name: "gifs", thumbnails: map[string][]string{
+		"0a": {"public/dance.gif"},
+		"0b": {"builds/logo.png"},
+	}}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	configMu.Lock()
+	thumbnailDir = dir
+	authzRules = []authzRule{
+		{Prefix: "public/", Everyone: true},
+		{Prefix: "builds/", Groups: []string{"eng"}},
+	}
+	configMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		configMu.Lock()
+		thumbnailDir, authzRules = "", nil
+		configMu.Unlock()
+	}()
+
+	for _, c := range []struct {
+		name string
+		id   *identity
+		want int
+	}{
+		{"0a", nil, http.StatusOK},
+		{"0b", nil, http.StatusNotFound},
+		{"0b", &identity{User: "alice", Groups: []string{"eng"}}, http.StatusOK},
+		{"0c", &identity{User: "alice", Groups: []string{"eng"}}, http.StatusNotFound},
+		{"../0a", nil, http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", "/-/thumbnails/"+c.name+".jpg", nil)
+		if c.id != nil {
+			r = r.WithContext(withIdentity(r.Context(), c.id))
+		}
+		w := httptest.NewRecorder()
+		thumbnailHandler(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s as %v: got status %d, want %d", c.name, c.id, w.Code, c.want)
+		}
+		if w.Code == http.StatusOK && w.Header().Get("Cache-Control") != "private, max-age=86400" {
+			t.Errorf("%s: got Cache-Control %q with authz rules", c.name, w.Header().Get("Cache-Control"))
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tlsVersions maps the -tls-min-version values to their constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherPolicies maps the -tls-ciphers values to the TLS 1.2 and earlier
+// cipher suites they allow. A nil list uses the Go defaults. TLS 1.3
+// suites are not configurable and are always enabled.
+var tlsCipherPolicies = map[string][]uint16{
+	"default": nil,
+	"modern": {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	},
+	"intermediate": {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	},
+}
+
+// newTLSConfig returns the TLS config for the server using the given
+// certificate store and the -tls-min-version and -tls-ciphers flags.
+func newTLSConfig(certs *certStore) *tls.Config {
+	return &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tlsVersions[tlsMinVersion],
+		CipherSuites:   tlsCipherPolicies[tlsCiphers],
+	}
+}
+
+// certStore holds the certificates served by the TLS listener, selected
+// by the server name the client asks for.
+type certStore struct {
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// newCertStore loads the certificate and key pair given by certFile and
+// keyFile, if any, and every <name>.crt and <name>.key pair in certDir.
+// It returns nil if there are no certificates to serve.
+func newCertStore(certFile, keyFile, certDir string) (*certStore, error) {
+	s := &certStore{}
+	if err := s.load(certFile, keyFile, certDir); err != nil {
+		return nil, err
+	}
+	if s.fallback == nil {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// load reads the certificates from disk and replaces the ones being served.
+func (s *certStore) load(certFile, keyFile, certDir string) error {
+	byName := map[string]*tls.Certificate{}
+	var fallback *tls.Certificate
+
+	if certFile != "" && keyFile != "" {
+		cert, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		fallback = cert
+	}
+
+	if certDir != "" {
+		files, err := ioutil.ReadDir(certDir)
+		if err != nil {
+			return fmt.Errorf("reading certificate directory %s failed: %v", certDir, err)
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".crt" {
+				continue
+			}
+			crt := filepath.Join(certDir, f.Name())
+			cert, err := loadCertificate(crt, strings.TrimSuffix(crt, ".crt")+".key")
+			if err != nil {
+				return err
+			}
+
+			names := cert.Leaf.DNSNames
+			if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+				names = []string{cert.Leaf.Subject.CommonName}
+			}
+			for _, n := range names {
+				byName[strings.ToLower(n)] = cert
+			}
+			if fallback == nil {
+				fallback = cert
+			}
+		}
+	}
+
+	modTimes := certModTimes(certFile, keyFile, certDir)
+
+	s.mu.Lock()
+	s.byName = byName
+	s.fallback = fallback
+	s.modTimes = modTimes
+	s.mu.Unlock()
+	return nil
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %s failed: %v", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate %s failed: %v", certFile, err)
+	}
+	return &cert, nil
+}
+
+// certModTimes returns the modification times of every certificate and key
+// file so changes on disk can be noticed.
+func certModTimes(certFile, keyFile, certDir string) map[string]time.Time {
+	paths := []string{certFile, keyFile}
+	if certDir != "" {
+		for _, ext := range []string{"*.crt", "*.key"} {
+			matches, _ := filepath.Glob(filepath.Join(certDir, ext))
+			paths = append(paths, matches...)
+		}
+	}
+	sort.Strings(paths)
+
+	modTimes := map[string]time.Time{}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			modTimes[p] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed returns true if any certificate or key file was added, removed or
+// modified since the certificates were last loaded.
+func (s *certStore) changed(certFile, keyFile, certDir string) bool {
+	current := certModTimes(certFile, keyFile, certDir)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(current) != len(s.modTimes) {
+		return true
+	}
+	for p, t := range current {
+		if !s.modTimes[p].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the certificates from the paths in the current config,
+// keeping the old ones if loading fails.
+func (s *certStore) reload() {
+	configMu.RLock()
+	c, k, d := certFile, keyFile, certDir
+	configMu.RUnlock()
+
+	if err := s.load(c, k, d); err != nil {
+		logrus.Warnf("reloading certificates failed, keeping the previous certificates: %v", err)
+		return
+	}
+	logrus.Info("Reloaded certificates")
+}
+
+// watch reloads the certificates whenever they change on disk.
+func (s *certStore) watch(every time.Duration) {
+	for range time.Tick(every) {
+		configMu.RLock()
+		c, k, d := certFile, keyFile, certDir
+		configMu.RUnlock()
+
+		if s.changed(c, k, d) {
+			s.reload()
+		}
+	}
+}
+
+// GetCertificate returns the certificate for the requested server name,
+// trying an exact match, then a wildcard match, then the fallback.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if s.fallback == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.fallback, nil
+}
+
+// redirectHandler redirects every request to the same URL over https on
+// the given port.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// otlpExporter is a trace.Exporter that sends spans to an OpenTelemetry
+// collector using the OTLP/HTTP JSON encoding.
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	spans []*trace.SpanData
+
+	flushc chan chan struct{}
+}
+
+// newOTLPExporter returns an exporter that posts batches of spans to the
+// collector at endpoint, for example http://localhost:4318.
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	e := &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		flushc:  make(chan chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// ExportSpan buffers a finished span until the next flush.
+func (e *otlpExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= otlpBatchSize
+	e.mu.Unlock()
+
+	if full {
+		go e.Flush()
+	}
+}
+
+// Flush sends all buffered spans and waits for the request to finish.
+func (e *otlpExporter) Flush() {
+	done := make(chan struct{})
+	e.flushc <- done
+	<-done
+}
+
+func (e *otlpExporter) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.send()
+		case done := <-e.flushc:
+			e.send()
+			close(done)
+		}
+	}
+}
+
+func (e *otlpExporter) send() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		logrus.Warnf("encoding %d spans failed: %v", len(spans), err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		logrus.Warnf("exporting %d spans to %s failed: %v", len(spans), e.url, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		logrus.Warnf("exporting %d spans to %s failed: %s", len(spans), e.url, resp.Status)
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func (e *otlpExporter) payload(spans []*trace.SpanData) map[string]interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              otlpSpanKind(s.SpanKind),
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentSpanID != (trace.SpanID{}) {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.Code != trace.StatusCodeOK {
+			// STATUS_CODE_ERROR
+			span.Status = otlpStatus{Code: 2, Message: s.Message}
+		}
+		out = append(out, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": e.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/jessfraz/s3server"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
+
+// otlpSpanKind maps an OpenCensus span kind to the OTLP enum.
+func otlpSpanKind(kind int) int {
+	switch kind {
+	case trace.SpanKindServer:
+		return 2
+	case trace.SpanKindClient:
+		return 3
+	default:
+		// SPAN_KIND_INTERNAL
+		return 1
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: value})
+	}
+	return kvs
+}
+
+// setSpanError marks a span as failed if err is not nil.
+func setSpanError(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+}
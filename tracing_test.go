@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("path: got %s, want /v1/traces", r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("content type: got %s, want application/json", ct)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	e := newOTLPExporter(collector.URL+"/", "s3server-test")
+	start := time.Unix(1500000000, 0)
+	e.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		ParentSpanID: trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+		SpanKind:     trace.SpanKindServer,
+		Name:         "GET /",
+		StartTime:    start,
+		EndTime:      start.Add(time.Second),
+		Attributes:   map[string]interface{}{"http.status_code": int64(500), "mount": "gifs"},
+		Status:       trace.Status{Code: trace.StatusCodeUnknown, Message: "listing failed"},
+	})
+	e.Flush()
+
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case b := <-bodies:
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Fatalf("decoding payload failed: %v\n%s", err, b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans were exported")
+	}
+
+	if len(payload.ResourceSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected one resource and scope, got %+v", payload)
+	}
+	res := payload.ResourceSpans[0]
+	if attrs := res.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value["stringValue"] != "s3server-test" {
+		t.Errorf("resource attributes: got %+v", attrs)
+	}
+
+	spans := res.ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(spans))
+	}
+	s := spans[0]
+	for _, c := range []struct{ name, got, want string }{
+		{"traceId", s.TraceID, "0102030405060708090a0b0c0d0e0f10"},
+		{"spanId", s.SpanID, "0102030405060708"},
+		{"parentSpanId", s.ParentSpanID, "0807060504030201"},
+		{"name", s.Name, "GET /"},
+		{"startTimeUnixNano", s.StartTimeUnixNano, "1500000000000000000"},
+		{"endTimeUnixNano", s.EndTimeUnixNano, "1500000001000000000"},
+		{"status.message", s.Status.Message, "listing failed"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, c.got, c.want)
+		}
+	}
+	if s.Kind != 2 {
+		t.Errorf("kind: got %d, want 2 (server)", s.Kind)
+	}
+	if s.Status.Code != 2 {
+		t.Errorf("status code: got %d, want 2 (error)", s.Status.Code)
+	}
+
+	attrs := map[string]map[string]interface{}{}
+	for _, kv := range s.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["http.status_code"]["intValue"]; v != "500" {
+		t.Errorf("http.status_code: got %v, want \"500\"", v)
+	}
+	if v := attrs["mount"]["stringValue"]; v != "gifs" {
+		t.Errorf("mount: got %v, want gifs", v)
+	}
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tusVersion is the version of the tus protocol that is supported.
+	tusVersion = "1.0.0"
+
+	// tusExtensions are the tus protocol extensions that are supported.
+	tusExtensions = "creation,termination,expiration"
+
+	// tusPartSize is the size of the parts uploads are sent to the
+	// provider in. It is over the 5MB s3 minimum and a multiple of the
+	// 256KiB gcs chunk size.
+	tusPartSize = 8 << 20
+)
+
+// tusUpload is the state of a resumable upload. It is saved to the upload
+// directory so uploads survive restarts. Data that does not fill a part yet
+// is kept in a spill file next to it.
+type tusUpload struct {
+	ID          string       `json:"id"`
+	Mount       string       `json:"mount"`
+	Key         string       `json:"key"`
+	ContentType string       `json:"contentType"`
+	Length      int64        `json:"length"`
+	Metadata    string       `json:"metadata,omitempty"`
+	User        string       `json:"user"`
+	UploadID    string       `json:"uploadId"`
+	Parts       []uploadPart `json:"parts"`
+	Spill       int64        `json:"spill"`
+	Created     time.Time    `json:"created"`
+	Updated     time.Time    `json:"updated"`
+
+	// busy is set while a request is working on the upload.
+	busy bool
+}
+
+// sent returns the number of bytes sent to the provider.
+func (u *tusUpload) sent() int64 {
+	var n int64
+	for _, p := range u.Parts {
+		n += p.Size
+	}
+	return n
+}
+
+// offset returns the number of bytes received.
+func (u *tusUpload) offset() int64 {
+	return u.sent() + u.Spill
+}
+
+// tusStore holds the resumable uploads in progress.
+type tusStore struct {
+	mu      sync.Mutex
+	dir     string
+	uploads map[string]*tusUpload
+}
+
+// tusUploads is set at startup.
+var tusUploads *tusStore
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadBusy     = errors.New("upload is already being written to")
+)
+
+// newTusStore loads the uploads saved in dir.
+func newTusStore(dir string) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating upload directory %s failed: %v", dir, err)
+	}
+
+	s := &tusStore{dir: dir, uploads: map[string]*tusUpload{}}
+	states, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		b, err := ioutil.ReadFile(state)
+		if err != nil {
+			return nil, fmt.Errorf("reading upload state %s failed: %v", state, err)
+		}
+		var u tusUpload
+		if err := json.Unmarshal(b, &u); err != nil {
+			logrus.Warnf("ignoring upload state %s: %v", state, err)
+			continue
+		}
+
+		// Data written after the state was last saved is dropped, the
+		// client resends it from the saved offset.
+		fi, err := os.Stat(s.spillPath(u.ID))
+		switch {
+		case err != nil:
+			u.Spill = 0
+		case fi.Size() < u.Spill:
+			u.Spill = fi.Size()
+		}
+		if err := s.truncateSpill(&u); err != nil {
+			return nil, err
+		}
+		s.uploads[u.ID] = &u
+	}
+	logrus.Infof("loaded %d resumable uploads from %s", len(s.uploads), dir)
+	return s, nil
+}
+
+func (s *tusStore) statePath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *tusStore) spillPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+// truncateSpill cuts the spill file down to the size in the state.
+func (s *tusStore) truncateSpill(u *tusUpload) error {
+	if err := os.Truncate(s.spillPath(u.ID), u.Spill); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("truncating upload data for %s failed: %v", u.ID, err)
+	}
+	return nil
+}
+
+// save writes the state of the upload to disk.
+func (s *tusStore) save(u *tusUpload) error {
+	u.Updated = time.Now()
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	tmp := s.statePath(u.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("saving upload state for %s failed: %v", u.ID, err)
+	}
+	if err := os.Rename(tmp, s.statePath(u.ID)); err != nil {
+		return fmt.Errorf("saving upload state for %s failed: %v", u.ID, err)
+	}
+	return nil
+}
+
+// add saves a new upload and starts tracking it.
+func (s *tusStore) add(u *tusUpload) error {
+	if err := s.save(u); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.uploads[u.ID] = u
+	s.mu.Unlock()
+	return nil
+}
+
+// remove stops tracking the upload and deletes its files.
+func (s *tusStore) remove(u *tusUpload) {
+	s.mu.Lock()
+	delete(s.uploads, u.ID)
+	s.mu.Unlock()
+
+	os.Remove(s.statePath(u.ID))
+	os.Remove(s.spillPath(u.ID))
+}
+
+// acquire returns the upload with the id and marks it busy until it is
+// released.
+func (s *tusStore) acquire(id string) (*tusUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, errUploadNotFound
+	}
+	if u.busy {
+		return nil, errUploadBusy
+	}
+	u.busy = true
+	return u, nil
+}
+
+func (s *tusStore) release(u *tusUpload) {
+	s.mu.Lock()
+	u.busy = false
+	s.mu.Unlock()
+}
+
+// abort aborts the upload at the provider and forgets it.
+func (s *tusStore) abort(ctx context.Context, u *tusUpload) error {
+	if m := mountNamed(u.Mount); m != nil {
+		if err := m.p.AbortUpload(ctx, u.Key, u.UploadID); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warnf("mount %s of upload %s no longer exists, dropping it without aborting", u.Mount, u.ID)
+	}
+	s.remove(u)
+	return nil
+}
+
+// expire aborts the uploads that have not been written to within maxAge.
+func (s *tusStore) expire(ctx context.Context, maxAge time.Duration) {
+	s.mu.Lock()
+	var expired []string
+	for id, u := range s.uploads {
+		if !u.busy && time.Since(u.Updated) > maxAge {
+			expired = append(expired, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		u, err := s.acquire(id)
+		if err != nil {
+			continue
+		}
+		if err := s.abort(ctx, u); err != nil {
+			logrus.Warnf("aborting expired upload %s of %s failed: %v", u.ID, u.Key, err)
+			s.release(u)
+			continue
+		}
+		logrus.Infof("aborted expired upload %s of %s", u.ID, u.Key)
+	}
+}
+
+// expireEvery runs expire on the given interval.
+func (s *tusStore) expireEvery(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expire(ctx, currentUploadExpiry())
+	}
+}
+
+// currentUploadExpiry returns how long an upload may sit idle.
+func currentUploadExpiry() time.Duration {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return uploadExpiry
+}
+
+// flush sends the spill file to the provider as the next part.
+func (s *tusStore) flush(ctx context.Context, m *mount, u *tusUpload, f *os.File) error {
+	n := len(u.Parts) + 1
+	etag, err := m.p.UploadPart(ctx, u.Key, u.UploadID, n, u.sent(), io.NewSectionReader(f, 0, u.Spill), u.Spill, u.Length)
+	if err != nil {
+		return err
+	}
+
+	u.Parts = append(u.Parts, uploadPart{N: n, ETag: etag, Size: u.Spill})
+	u.Spill = 0
+	if err := s.save(u); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// parseTusMetadata parses an Upload-Metadata header.
+func parseTusMetadata(h string) (map[string]string, error) {
+	md := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, " ", 2)
+		if len(parts) == 1 {
+			md[parts[0]] = ""
+			continue
+		}
+		v, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", parts[0])
+		}
+		md[parts[0]] = string(v)
+	}
+	return md, nil
+}
+
+// tusHandler implements the tus resumable upload protocol under
+// /api/v1/uploads/.
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	method := r.Method
+	if o := r.Header.Get("X-HTTP-Method-Override"); o != "" {
+		method = o
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if max := maxUploadBytes(); max > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/uploads/")
+	switch {
+	case id == "" && method == http.MethodPost:
+		tusCreate(w, r)
+	case id != "" && method == http.MethodHead:
+		tusHead(w, r, id)
+	case id != "" && method == http.MethodPatch:
+		tusPatch(w, r, id)
+	case id != "" && method == http.MethodDelete:
+		tusDelete(w, r, id)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// setUploadExpires sets the Upload-Expires header for the upload.
+func setUploadExpires(w http.ResponseWriter, u *tusUpload) {
+	w.Header().Set("Upload-Expires", u.Updated.Add(currentUploadExpiry()).UTC().Format(http.TimeFormat))
+}
+
+// tusCreate starts a new upload. The object key is taken from the key
+// metadata, or else the filename metadata under the mount's prefix.
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if max := maxUploadBytes(); max > 0 && length > max {
+		http.Error(w, errTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	md, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, err := apiMount(r, md["mount"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	key := md["key"]
+	if key == "" && md["filename"] != "" {
+		key = m.keyPrefix() + filepath.Base(filepath.FromSlash(md["filename"]))
+	}
+	key, err = m.objectKey(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := identityFrom(r.Context())
+	if !authzCanWrite(currentAuthzRules(), id, m.name, key) {
+		http.Error(w, fmt.Sprintf("not allowed to write %s", key), http.StatusForbidden)
+		return
+	}
+
+	contentType := uploadContentType(key)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	location := "/api/v1/uploads/" + hex.EncodeToString(b)
+
+	// There is nothing to resume for an empty object.
+	if length == 0 {
+		_, err := m.upload(r.Context(), key, strings.NewReader(""), 0, contentType)
+		audit(r, "upload", m, key, "", err)
+		if err != nil {
+			logrus.Warnf("uploading %s to mount %s failed: %v", key, m.name, err)
+			http.Error(w, fmt.Sprintf("uploading %s failed", key), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	uploadID, err := m.p.InitUpload(r.Context(), key, contentType)
+	if err != nil {
+		logrus.Warnf("starting upload of %s to mount %s failed: %v", key, m.name, err)
+		http.Error(w, fmt.Sprintf("starting upload of %s failed", key), http.StatusBadGateway)
+		return
+	}
+
+	u := &tusUpload{
+		ID:          hex.EncodeToString(b),
+		Mount:       m.name,
+		Key:         key,
+		ContentType: contentType,
+		Length:      length,
+		Metadata:    r.Header.Get("Upload-Metadata"),
+		User:        id.User,
+		UploadID:    uploadID,
+		Created:     time.Now(),
+	}
+	if err := tusUploads.add(u); err != nil {
+		logrus.Warn(err)
+		m.p.AbortUpload(r.Context(), key, uploadID)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	setUploadExpires(w, u)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusAcquire returns the upload for the request, if it belongs to the
+// requesting user, writing an error response otherwise.
+func tusAcquire(w http.ResponseWriter, r *http.Request, id string) *tusUpload {
+	u, err := tusUploads.acquire(id)
+	if err == errUploadBusy {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+
+	if who := identityFrom(r.Context()); who == nil || who.User != u.User {
+		tusUploads.release(u)
+		http.Error(w, errUploadNotFound.Error(), http.StatusNotFound)
+		return nil
+	}
+	return u
+}
+
+// tusHead reports how much of an upload has been received.
+func tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	u := tusAcquire(w, r, id)
+	if u == nil {
+		return
+	}
+	defer tusUploads.release(u)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	setUploadExpires(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// tusPatch appends the request body to an upload, sending every full part
+// on to the provider, and completes the upload once all of it is in.
+func tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	u := tusAcquire(w, r, id)
+	if u == nil {
+		return
+	}
+	defer tusUploads.release(u)
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != u.offset() {
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+
+	m := mountNamed(u.Mount)
+	if m == nil {
+		http.Error(w, fmt.Sprintf("mount %s no longer exists", u.Mount), http.StatusGone)
+		return
+	}
+
+	f, err := os.OpenFile(tusUploads.spillPath(u.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logrus.Warnf("opening upload data for %s failed: %v", u.ID, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(u.Spill, io.SeekStart); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// A part that failed to send before is retried first.
+	if u.Spill == tusPartSize {
+		if err := tusUploads.flush(r.Context(), m, u, f); err != nil {
+			logrus.Warnf("sending part of upload %s failed: %v", u.ID, err)
+			http.Error(w, "sending part to the provider failed", http.StatusBadGateway)
+			return
+		}
+	}
+
+	// Read at most what is left of the upload, parts are cut at exactly
+	// tusPartSize.
+	body := io.LimitReader(r.Body, u.Length-u.offset())
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		for chunk := buf[:n]; len(chunk) > 0; {
+			k := int64(len(chunk))
+			if k > tusPartSize-u.Spill {
+				k = tusPartSize - u.Spill
+			}
+			if _, err := f.Write(chunk[:k]); err != nil {
+				logrus.Warnf("writing upload data for %s failed: %v", u.ID, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			u.Spill += k
+			chunk = chunk[k:]
+
+			if u.Spill == tusPartSize {
+				if err := tusUploads.flush(r.Context(), m, u, f); err != nil {
+					tusUploads.save(u)
+					logrus.Warnf("sending part of upload %s failed: %v", u.ID, err)
+					http.Error(w, "sending part to the provider failed", http.StatusBadGateway)
+					return
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// Keep what was received so the client can resume.
+			logrus.Debugf("reading upload data for %s stopped: %v", u.ID, readErr)
+			break
+		}
+	}
+
+	if u.offset() < u.Length {
+		if err := tusUploads.save(u); err != nil {
+			logrus.Warn(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		setUploadExpires(w, u)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset(), 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// All of the upload is in, send the rest and put it together.
+	if u.Spill > 0 {
+		if err := tusUploads.flush(r.Context(), m, u, f); err != nil {
+			logrus.Warnf("sending last part of upload %s failed: %v", u.ID, err)
+			http.Error(w, "sending part to the provider failed", http.StatusBadGateway)
+			return
+		}
+	}
+	o, err := m.p.CompleteUpload(r.Context(), u.Key, u.UploadID, u.Parts)
+	audit(r, "upload", m, u.Key, "", err)
+	if err != nil {
+		logrus.Warnf("completing upload %s of %s failed: %v", u.ID, u.Key, err)
+		http.Error(w, "completing the upload failed", http.StatusBadGateway)
+		return
+	}
+	tusUploads.remove(u)
+
+	if o.ContentType == "" {
+		o.ContentType = u.ContentType
+	}
+	if err := m.updateIndex(r.Context(), nil, o); err != nil {
+		logrus.Warnf("adding %s to the index for mount %s failed: %v", u.Key, m.name, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Length, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDelete aborts an upload.
+func tusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	u := tusAcquire(w, r, id)
+	if u == nil {
+		return
+	}
+
+	if err := tusUploads.abort(r.Context(), u); err != nil {
+		tusUploads.release(u)
+		logrus.Warnf("aborting upload %s of %s failed: %v", u.ID, u.Key, err)
+		http.Error(w, "aborting the upload failed", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
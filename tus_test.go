@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tusRequest makes a tus request as the user, or anonymously if user is "".
+func tusRequest(method, target, user string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	if user != "" {
+		r = r.WithContext(withIdentity(r.Context(), &identity{User: user}))
+	}
+	w := httptest.NewRecorder()
+	tusHandler(w, r)
+	return w
+}
+
+// tusCreateUpload starts an upload of dance.gif and returns its location.
+func tusCreateUpload(t *testing.T, length int) string {
+	w := tusRequest("POST", "/api/v1/uploads/", "alice", nil,
+		"Upload-Length", strconv.Itoa(length),
+		"Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("dance.gif")))
+	if w.Code != http.StatusCreated || w.Header().Get("Location") == "" {
+		t.Fatalf("creating the upload: got status %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func tusPatchUpload(loc, user string, offset int, data []byte) *httptest.ResponseRecorder {
+	return tusRequest("PATCH", loc, user, data,
+		"Content-Type", "application/offset+octet-stream",
+		"Upload-Offset", strconv.Itoa(offset))
+}
+
+func TestTusUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3server-tus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newTusStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newFakeCloud("/", nil)
+	mountsMu.Lock()
+	mounts = []*mount{{name: "gifs", path: "/", p: p}}
+	mountsMu.Unlock()
+	configMu.Lock()
+	uploadExpiry = time.Hour
+	configMu.Unlock()
+	tusUploads = store
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		configMu.Lock()
+		uploadExpiry = 0
+		configMu.Unlock()
+		tusUploads = nil
+	}()
+	content := func(key string) string {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return string(p.objects[key])
+	}
+
+	if w := tusRequest("OPTIONS", "/api/v1/uploads/", "", nil); w.Code != http.StatusNoContent || w.Header().Get("Tus-Version") != tusVersion {
+		t.Errorf("options: got status %d, version %q", w.Code, w.Header().Get("Tus-Version"))
+	}
+	r := httptest.NewRequest("POST", "/api/v1/uploads/", nil)
+	w := httptest.NewRecorder()
+	tusHandler(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("without Tus-Resumable: got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+
+	loc := tusCreateUpload(t, 10)
+	if w := tusRequest("HEAD", loc, "alice", nil); w.Header().Get("Upload-Offset") != "0" || w.Header().Get("Upload-Length") != "10" {
+		t.Errorf("head of a new upload: got offset %q, length %q", w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+
+	// the upload is only visible to the user who started it
+	if w := tusRequest("HEAD", loc, "bob", nil); w.Code != http.StatusNotFound {
+		t.Errorf("head as another user: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// data must continue at the offset received so far
+	if w := tusPatchUpload(loc, "alice", 5, []byte("a1234")); w.Code != http.StatusConflict {
+		t.Errorf("patch at the wrong offset: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := tusPatchUpload(loc, "alice", 0, []byte("GIF89")); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("first patch: got status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if got := content("dance.gif"); got != "" {
+		t.Errorf("object written before the upload is complete: %q", got)
+	}
+
+	// the state survives a restart
+	if tusUploads, err = newTusStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if w := tusRequest("HEAD", loc, "alice", nil); w.Header().Get("Upload-Offset") != "5" {
+		t.Errorf("head after a restart: got offset %q, want 5", w.Header().Get("Upload-Offset"))
+	}
+
+	if w := tusPatchUpload(loc, "alice", 5, []byte("a1234")); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("last patch: got status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if got := content("dance.gif"); got != "GIF89a1234" {
+		t.Errorf("completed upload: got %q, want %q", got, "GIF89a1234")
+	}
+	if w := tusRequest("HEAD", loc, "alice", nil); w.Code != http.StatusNotFound {
+		t.Errorf("head of a completed upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// uploads over a part are sent in parts
+	big := bytes.Repeat([]byte("0123456789abcdef"), tusPartSize/16+1)
+	loc = tusCreateUpload(t, len(big))
+	if w := tusPatchUpload(loc, "alice", 0, big); w.Code != http.StatusNoContent {
+		t.Errorf("big upload: got status %d: %s", w.Code, w.Body)
+	}
+	if got := content("dance.gif"); got != string(big) {
+		t.Errorf("big upload: got %d bytes, want %d", len(got), len(big))
+	}
+
+	// idle uploads expire and are aborted
+	loc = tusCreateUpload(t, 10)
+	tusUploads.mu.Lock()
+	for _, u := range tusUploads.uploads {
+		u.Updated = time.Now().Add(-2 * time.Hour)
+	}
+	tusUploads.mu.Unlock()
+	tusUploads.expire(context.Background(), time.Hour)
+	if w := tusRequest("HEAD", loc, "alice", nil); w.Code != http.StatusNotFound {
+		t.Errorf("head of an expired upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// deleting aborts the upload at the provider
+	loc = tusCreateUpload(t, 10)
+	if w := tusRequest("DELETE", loc, "alice", nil); w.Code != http.StatusNoContent {
+		t.Errorf("delete: got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	p.mu.Lock()
+	if len(p.uploads) != 0 {
+		t.Errorf("%d uploads left at the provider, want 0", len(p.uploads))
+	}
+	p.mu.Unlock()
+}
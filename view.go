@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	units "github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// maxTextPreview is how much of a text object its page shows.
+const maxTextPreview = 64 << 10
+
+// viewData is the data of the page of an object.
+type viewData struct {
+	Mount       string
+	Index       string
+	Name        string
+	Base        string
+	Title       string
+	Description string
+	// Summary is the description, or else the type and size.
+	Summary     string
+	Tags        []string
+	Size        string
+	ContentType string
+	Modified    string
+
+	// Kind is image, video, audio, pdf or text for objects that are
+	// previewed, or empty.
+	Kind string
+	// URL is the absolute URL of the object, PageURL that of the page and
+	// ImageURL that of the image shown when the page is linked to.
+	URL      string
+	PageURL  string
+	ImageURL string
+	Text     string
+
+	// EmbedHTML and EmbedMarkdown are snippets that show the object
+	// elsewhere.
+	EmbedHTML     string
+	EmbedMarkdown string
+}
+
+// previewKind returns how an object with the content type is previewed.
+func previewKind(contentType string) string {
+	ct := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		return "image"
+	case strings.HasPrefix(ct, "video/"):
+		return "video"
+	case strings.HasPrefix(ct, "audio/"):
+		return "audio"
+	case ct == "application/pdf":
+		return "pdf"
+	case strings.HasPrefix(ct, "text/"), ct == "application/json", ct == "application/xml", ct == "application/javascript":
+		return "text"
+	}
+	return ""
+}
+
+// viewHandler serves /view/<key>, a page for an object of a mount with a
+// preview, its details, snippets to embed it and OpenGraph and Twitter
+// card tags, so that links to it unfurl with the object.
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	m, err := apiMount(r, r.URL.Query().Get("mount"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	key, err := m.objectKey(strings.TrimPrefix(r.URL.Path, "/view/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rules := currentAuthzRules()
+	if !authzAllowed(rules, identityFrom(r.Context()), m.name, key) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var o object
+	found := false
+	files, _ := m.listing()
+	for _, f := range files {
+		if f.Name == key {
+			o, found = f, true
+			break
+		}
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	// link through the object handler like the index rendered for the
+	// viewer does
+	site := m.siteURL(r)
+	objectURL := requestScheme(r) + "://" + o.BaseURL + "/" + escapeKeyPath(o.Name)
+	if m.proxied(rules) {
+		objectURL = site + "/-/objects/" + m.name + "/" + escapeKeyPath(o.Name)
+	}
+
+	ct := contentTypeFor(o.Name, o.ContentType)
+	d := viewData{
+		Mount:       m.name,
+		Index:       m.path,
+		Name:        o.Name,
+		Base:        path.Base(o.Name),
+		Title:       o.Title,
+		Description: o.Description,
+		Tags:        o.Tags,
+		Size:        units.HumanSize(float64(o.Size)),
+		ContentType: ct,
+		Kind:        previewKind(ct),
+		URL:         objectURL,
+		PageURL:     site + r.URL.RequestURI(),
+	}
+	if d.Title == "" {
+		d.Title = d.Base
+	}
+	d.Summary = d.Description
+	if d.Kind == "pdf" && m.proxied(rules) {
+		// the object handler sends PDFs as attachments, so they are
+		// linked to rather than embedded
+		d.Kind = ""
+	}
+	if d.Summary == "" {
+		d.Summary = fmt.Sprintf("%s, %s", ct, d.Size)
+	}
+	if !o.Modified.IsZero() {
+		d.Modified = o.Modified.Local().Format(time.RFC1123)
+	}
+
+	switch d.Kind {
+	case "image":
+		d.ImageURL = objectURL
+		d.EmbedHTML = fmt.Sprintf(`<img src="%s" alt="%s">`, template.HTMLEscapeString(objectURL), template.HTMLEscapeString(d.Title))
+		d.EmbedMarkdown = fmt.Sprintf("![%s](%s)", d.Title, objectURL)
+	case "video", "audio":
+		d.EmbedHTML = fmt.Sprintf(`<%s src="%s" controls></%s>`, d.Kind, template.HTMLEscapeString(objectURL), d.Kind)
+		d.EmbedMarkdown = fmt.Sprintf("[%s](%s)", d.Title, objectURL)
+	default:
+		d.EmbedHTML = fmt.Sprintf(`<a href="%s">%s</a>`, template.HTMLEscapeString(objectURL), template.HTMLEscapeString(d.Title))
+		d.EmbedMarkdown = fmt.Sprintf("[%s](%s)", d.Title, objectURL)
+	}
+	if d.ImageURL == "" && o.Thumbnail != "" {
+		d.ImageURL = site + "/-/thumbnails/" + o.Thumbnail + ".jpg"
+	}
+
+	if d.Kind == "text" {
+		d.Text, err = m.previewText(r, key)
+		if err != nil {
+			logrus.Debugf("reading %s in mount %s for its page failed: %v", key, m.name, err)
+			d.Kind = ""
+		}
+	}
+
+	var b bytes.Buffer
+	if err := m.renderView(&b, d); err != nil {
+		logrus.Warnf("rendering the page of %s in mount %s failed: %v", key, m.name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if len(rules) > 0 {
+		w.Header().Set("Cache-Control", "private")
+	}
+	w.Write(b.Bytes())
+}
+
+// previewText returns the start of a text object, or an error if it is
+// not valid UTF-8.
+func (m *mount) previewText(r *http.Request, key string) (string, error) {
+	body, _, err := m.p.Open(r.Context(), key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxTextPreview))
+	if err != nil {
+		return "", err
+	}
+	// drop a rune cut off at the limit
+	for i := 0; i < utf8.UTFMax && len(b) > 0 && !utf8.Valid(b); i++ {
+		b = b[:len(b)-1]
+	}
+	if !utf8.Valid(b) {
+		return "", fmt.Errorf("%s is not UTF-8 text", key)
+	}
+	return string(b), nil
+}
+
+// renderView executes the view template next to the mount's templates.
+func (m *mount) renderView(w io.Writer, d viewData) error {
+	vp := filepath.Join(templateDir(m.assets), "view.html")
+	tmpl, err := template.New("").ParseFiles(vp)
+	if err != nil {
+		return fmt.Errorf("parsing view template failed: %v", err)
+	}
+	if err := tmpl.ExecuteTemplate(w, "view", d); err != nil {
+		return fmt.Errorf("execute view template failed: %v", err)
+	}
+	return nil
+}
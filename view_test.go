@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestViewHandlerURLs(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{"dance.gif": "GIF89a", "report.pdf": "%PDF-1.4"})
+	m := &mount{name: "gifs", path: "/", hosts: []string{"gifs.example.com"}, p: p, assets: "static"}
+	m.files = []object{
+		{Name: "dance.gif", BaseURL: p.baseURL, ContentType: "image/gif"},
+		{Name: "report.pdf", BaseURL: p.baseURL, ContentType: "application/pdf", Thumbnail: "0123abcd"},
+	}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	configMu.Lock()
+	templates, publicURL = "templates", ""
+	configMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		configMu.Lock()
+		templates, publicURL = "", ""
+		configMu.Unlock()
+	}()
+
+	view := func(host string) string {
+		r := httptest.NewRequest("GET", "/view/report.pdf", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		viewHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", host, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+
+	// a Host that is not the mount's does not end up in the links
+	page := view("evil.example.com")
+	if strings.Contains(page, "evil.example.com") {
+		t.Errorf("the page links to the request's Host:\n%s", page)
+	}
+	if !strings.Contains(page, `<meta property="og:url" content="/view/report.pdf">`) {
+		t.Errorf("the page URL is not relative:\n%s", page)
+	}
+
+	page = view("gifs.example.com")
+	for _, want := range []string{
+		`<meta property="og:url" content="http://gifs.example.com/view/report.pdf">`,
+		`<meta property="og:image" content="http://gifs.example.com/-/thumbnails/0123abcd.jpg">`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("missing %s:\n%s", want, page)
+		}
+	}
+
+	configMu.Lock()
+	publicURL = "https://pics.example.com/"
+	configMu.Unlock()
+	page = view("evil.example.com")
+	if !strings.Contains(page, `<meta property="og:url" content="https://pics.example.com/view/report.pdf">`) || strings.Contains(page, "evil.example.com") {
+		t.Errorf("the page does not link to the public URL:\n%s", page)
+	}
+
+	// PDFs in the bucket are embedded, those sent as attachments by the
+	// object handler are linked to
+	if !strings.Contains(page, `<iframe src="http://bucket.example.com/report.pdf"`) {
+		t.Errorf("the PDF in the bucket is not embedded:\n%s", page)
+	}
+	p.baseURL = ""
+	page = view("gifs.example.com")
+	if strings.Contains(page, "<iframe") {
+		t.Errorf("the PDF from the object handler is embedded:\n%s", page)
+	}
+	if !strings.Contains(page, `href="https://pics.example.com/-/objects/gifs/report.pdf"`) {
+		t.Errorf("the PDF from the object handler is not linked to:\n%s", page)
+	}
+}
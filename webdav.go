@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// davWriteMethods are the WebDAV methods that change the bucket.
+var davWriteMethods = map[string]string{
+	"PUT":       "upload",
+	"DELETE":    "delete",
+	"MKCOL":     "mkdir",
+	"COPY":      "copy",
+	"MOVE":      "move",
+	"PROPPATCH": "",
+	"LOCK":      "",
+	"UNLOCK":    "",
+}
+
+// currentWebDAVWritable returns true if WebDAV clients may change the
+// bucket.
+func currentWebDAVWritable() bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return webdavWritable
+}
+
+// davHandler serves the mounts over WebDAV under prefix. Every mount is a
+// directory at the root, holding its objects by key relative to the
+// mount's bucket prefix.
+func davHandler(prefix string) http.Handler {
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: davFS{},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			action := davWriteMethods[r.Method]
+			if action == "" {
+				if err != nil {
+					logrus.Debugf("webdav %s %s failed: %v", r.Method, r.URL.Path, err)
+				}
+				return
+			}
+
+			m, key, _ := davResolve(strings.TrimPrefix(r.URL.Path, prefix))
+			if m == nil {
+				return
+			}
+			var dst string
+			if u, uerr := url.Parse(r.Header.Get("Destination")); uerr == nil && u.Path != "" {
+				if dm, dkey, _ := davResolve(strings.TrimPrefix(u.Path, prefix)); dm == m {
+					dst = dkey
+				}
+			}
+			audit(r, action, m, key, dst, err)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, write := davWriteMethods[r.Method]
+		writable := currentWebDAVWritable()
+
+		// clients decide whether to mount read-only from the options
+		if r.Method == http.MethodOptions && !writable {
+			w.Header().Set("DAV", "1")
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+			w.Header().Set("MS-Author-Via", "DAV")
+			return
+		}
+
+		if write {
+			if !writable {
+				http.Error(w, "WebDAV is read-only", http.StatusMethodNotAllowed)
+				return
+			}
+			if identityFrom(r.Context()) == nil {
+				http.Error(w, "writes require authentication", http.StatusForbidden)
+				return
+			}
+			names := []string{strings.TrimPrefix(r.URL.Path, prefix)}
+			if u, err := url.Parse(r.Header.Get("Destination")); err == nil && u.Path != "" {
+				names = append(names, strings.TrimPrefix(u.Path, prefix))
+			}
+			for _, name := range names {
+				if !davCanWrite(r.Context(), name) {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		// objects are served from the same origin as the pages
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			setObjectHeaders(w.Header(), r.URL.Path, "")
+		}
+
+		// the handler closes the file even if the body could not be read
+		if r.Method == http.MethodPut {
+			body := &davBody{ReadCloser: r.Body}
+			r.Body = body
+			r = r.WithContext(context.WithValue(r.Context(), davBodyKey{}, body))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// davResolve returns the mount and key for a WebDAV path. The root has no
+// mount, and the root of a mount has the mount's bucket prefix as key.
+func davResolve(name string) (*mount, string, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil, "", nil
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	m := mountNamed(parts[0])
+	if m == nil {
+		return nil, "", os.ErrNotExist
+	}
+
+	var rel string
+	if len(parts) == 2 {
+		rel = parts[1]
+	}
+	return m, m.bucketKey(rel), nil
+}
+
+// davRoot returns true if the key is the root of the mount.
+func (m *mount) davRoot(key string) bool {
+	return key == m.keyPrefix()
+}
+
+// davCanWrite returns true if the identity in ctx may change the object or
+// directory at the WebDAV path.
+func davCanWrite(ctx context.Context, name string) bool {
+	m, key, err := davResolve(name)
+	if err != nil || m == nil || m.davRoot(key) {
+		return false
+	}
+	return authzCanWrite(currentAuthzRules(), identityFrom(ctx), m.name, key)
+}
+
+// davInfo describes an object or directory.
+type davInfo struct {
+	name        string
+	size        int64
+	modified    time.Time
+	dir         bool
+	contentType string
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modified }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() interface{}   { return nil }
+
+func (i *davInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType implements webdav.ContentTyper, so objects are not opened to
+// sniff their type.
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.contentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.contentType, nil
+}
+
+// davDir returns the prefix of the keys under the directory at key.
+func (m *mount) davDir(key string) string {
+	if m.davRoot(key) {
+		return key
+	}
+	return key + "/"
+}
+
+// davEntries returns the objects the identity in ctx can read from the
+// listing of the mount that are at key or under the directory at key.
+func (m *mount) davEntries(ctx context.Context, key string) []object {
+	files, _ := m.listing()
+	rules := currentAuthzRules()
+	id := identityFrom(ctx)
+	dir := m.davDir(key)
+
+	var entries []object
+	for _, f := range files {
+		if (f.Name == key || strings.HasPrefix(f.Name, dir)) && authzAllowed(rules, id, m.name, f.Name) {
+			entries = append(entries, f)
+		}
+	}
+	return entries
+}
+
+// davStat describes the object or directory at key in the mount.
+func (m *mount) davStat(ctx context.Context, key string) (*davInfo, error) {
+	dir := m.davDir(key)
+
+	info := &davInfo{name: path.Base("/" + key), dir: true}
+	if m.davRoot(key) {
+		info.name = m.name
+	}
+	found := m.davRoot(key)
+	for _, f := range m.davEntries(ctx, key) {
+		switch {
+		case f.Name == key:
+			return &davInfo{
+				name:        info.name,
+				size:        f.Size,
+				modified:    f.Modified,
+				contentType: contentTypeFor(f.Name, f.ContentType),
+			}, nil
+		case strings.HasPrefix(f.Name, dir):
+			found = true
+			if f.Modified.After(info.modified) {
+				info.modified = f.Modified
+			}
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return info, nil
+}
+
+// davReaddir describes the objects and directories directly under the
+// directory at key in the mount.
+func (m *mount) davReaddir(ctx context.Context, key string) []os.FileInfo {
+	dir := m.davDir(key)
+
+	dirs := map[string]*davInfo{}
+	var infos []os.FileInfo
+	for _, f := range m.davEntries(ctx, key) {
+		rest := strings.TrimPrefix(f.Name, dir)
+		if f.Name == key || rest == "" {
+			// the placeholder object of the directory itself
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			d, ok := dirs[rest[:i]]
+			if !ok {
+				d = &davInfo{name: rest[:i], dir: true}
+				dirs[d.name] = d
+				infos = append(infos, d)
+			}
+			if f.Modified.After(d.modified) {
+				d.modified = f.Modified
+			}
+			continue
+		}
+		infos = append(infos, &davInfo{
+			name:        rest,
+			size:        f.Size,
+			modified:    f.Modified,
+			contentType: contentTypeFor(f.Name, f.ContentType),
+		})
+	}
+	return infos
+}
+
+// davFS is a webdav.FileSystem over the mounts. Stats and directory
+// listings come from the mounts' listings, and reads and writes go through
+// their providers.
+type davFS struct{}
+
+func (davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	m, key, err := davResolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return &davInfo{name: "/", dir: true}, nil
+	}
+	return m.davStat(ctx, key)
+}
+
+func (davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	m, key, err := davResolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if !davCanWrite(ctx, name) {
+			return nil, os.ErrPermission
+		}
+		if _, err := m.objectKey(key); err != nil {
+			return nil, os.ErrInvalid
+		}
+		return newDavWriter(ctx, m, key), nil
+	}
+
+	if m == nil {
+		var infos []os.FileInfo
+		mountsMu.RLock()
+		for _, m := range mounts {
+			info, _ := m.davStat(ctx, m.bucketKey(""))
+			infos = append(infos, info)
+		}
+		mountsMu.RUnlock()
+		return &davDir{info: &davInfo{name: "/", dir: true}, entries: infos}, nil
+	}
+
+	info, err := m.davStat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.dir {
+		return &davDir{info: info, entries: m.davReaddir(ctx, key)}, nil
+	}
+	return &davReader{objectReader: newObjectReader(ctx, m.p, key, info.size), info: info}, nil
+}
+
+func (davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	m, key, err := davResolve(name)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.davRoot(key) {
+		return os.ErrExist
+	}
+	if _, err := m.davStat(ctx, key); err == nil {
+		return os.ErrExist
+	}
+	if !davCanWrite(ctx, name) {
+		return os.ErrPermission
+	}
+	if _, err := m.objectKey(key); err != nil {
+		return os.ErrInvalid
+	}
+
+	// object stores have no directories, so keep an empty placeholder
+	// object for it until something is put in it
+	_, err = m.upload(ctx, key+"/", bytes.NewReader(nil), 0, "application/x-directory")
+	return err
+}
+
+func (davFS) RemoveAll(ctx context.Context, name string) error {
+	m, key, err := davResolve(name)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.davRoot(key) {
+		return os.ErrPermission
+	}
+
+	keys, err := m.davKeys(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := m.p.Delete(ctx, keys...); err != nil {
+		return err
+	}
+	if err := m.updateIndex(ctx, keys); err != nil {
+		logrus.Warnf("removing %s from the index for mount %s failed: %v", key, m.name, err)
+	}
+	return nil
+}
+
+func (davFS) Rename(ctx context.Context, oldName, newName string) error {
+	m, src, err := davResolve(oldName)
+	if err != nil {
+		return err
+	}
+	dm, dst, err := davResolve(newName)
+	if err != nil {
+		return err
+	}
+	if m == nil || dm != m || m.davRoot(src) || m.davRoot(dst) {
+		return os.ErrPermission
+	}
+	if _, err := m.objectKey(dst); err != nil {
+		return os.ErrInvalid
+	}
+
+	keys, err := m.davKeys(ctx, src)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !authzCanWrite(currentAuthzRules(), identityFrom(ctx), m.name, dst+strings.TrimPrefix(k, src)) {
+			return os.ErrPermission
+		}
+	}
+
+	// objects are moved one by one, so keep the index up to date with the
+	// ones that made it if one fails
+	var moved []string
+	var added []object
+	for _, k := range keys {
+		o, err := m.p.Move(ctx, k, dst+strings.TrimPrefix(k, src))
+		if err != nil {
+			break
+		}
+		moved = append(moved, k)
+		added = append(added, o)
+	}
+	if err := m.updateIndex(ctx, moved, added...); err != nil {
+		logrus.Warnf("moving %s in the index for mount %s failed: %v", src, m.name, err)
+	}
+	if len(moved) < len(keys) {
+		return errors.New("moving " + keys[len(moved)] + " failed")
+	}
+	return nil
+}
+
+// davKeys returns the key of the object at key, or the keys of every
+// object in the directory at key. The identity in ctx must be allowed to
+// change all of them.
+func (m *mount) davKeys(ctx context.Context, key string) ([]string, error) {
+	files, _ := m.listing()
+	rules := currentAuthzRules()
+	id := identityFrom(ctx)
+
+	var keys []string
+	for _, f := range files {
+		if f.Name != key && !strings.HasPrefix(f.Name, key+"/") {
+			continue
+		}
+		if !authzCanWrite(rules, id, m.name, f.Name) {
+			return nil, os.ErrPermission
+		}
+		keys = append(keys, f.Name)
+	}
+	if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return keys, nil
+}
+
+// davDir is an open directory.
+type davDir struct {
+	info    *davInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrInvalid }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
+
+// davReader is an object open for reading.
+type davReader struct {
+	*objectReader
+	info *davInfo
+}
+
+func (f *davReader) Stat() (os.FileInfo, error)               { return f.info, nil }
+func (f *davReader) Write(p []byte) (int, error)              { return 0, os.ErrPermission }
+func (f *davReader) Readdir(count int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+// davBody is the body of a PUT. It keeps the error reading it, so that the
+// upload can be aborted instead of saving part of the object.
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+type davBodyKey struct{}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// davWriter is an object open for writing. Writes are streamed into the
+// provider, and the object is added to the index when it is closed.
+type davWriter struct {
+	info *davInfo
+	body *davBody
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDavWriter(ctx context.Context, m *mount, key string) *davWriter {
+	pr, pw := io.Pipe()
+	f := &davWriter{
+		info: &davInfo{name: path.Base(key), modified: time.Now()},
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	f.body, _ = ctx.Value(davBodyKey{}).(*davBody)
+	go func() {
+		_, err := m.upload(ctx, key, newLimitReader(pr), -1, contentTypeFor(key, ""))
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *davWriter) Stat() (os.FileInfo, error)                   { return f.info, nil }
+func (f *davWriter) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (f *davWriter) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (f *davWriter) Readdir(count int) ([]os.FileInfo, error)     { return nil, os.ErrInvalid }
+
+func (f *davWriter) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	f.info.size += int64(n)
+	return n, err
+}
+
+func (f *davWriter) Close() error {
+	if f.body != nil && f.body.err != nil {
+		f.pw.CloseWithError(f.body.err)
+	} else {
+		f.pw.Close()
+	}
+	return <-f.done
+}
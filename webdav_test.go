@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDavReaddir(t *testing.T) {
+	p := newFakeCloud("gifs", nil)
+	m := &mount{name: "gifs", p: p}
+	for _, name := range []string{
+		"gifs/dance.gif",
+		"gifs/foo/one.gif",
+		"gifs/foobar/two.gif",
+		"gifs-private/secret.gif",
+	} {
+		m.files = append(m.files, object{Name: name, Size: 1})
+	}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+	}()
+
+	ctx := context.Background()
+	for _, c := range []struct {
+		name string
+		want []string
+	}{
+		{"/", []string{"gifs"}},
+		{"/gifs", []string{"dance.gif", "foo", "foobar"}},
+		{"/gifs/foo", []string{"one.gif"}},
+	} {
+		f, err := davFS{}.OpenFile(ctx, c.name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Errorf("%s: opening failed: %v", c.name, err)
+			continue
+		}
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			t.Errorf("%s: reading failed: %v", c.name, err)
+			continue
+		}
+		var got []string
+		for _, i := range infos {
+			got = append(got, i.Name())
+		}
+		sort.Strings(got)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+
+	if _, err := (davFS{}).Stat(ctx, "/gifs/fo"); !os.IsNotExist(err) {
+		t.Errorf("stat of a partial directory name: got %v, want not found", err)
+	}
+	if info, err := (davFS{}).Stat(ctx, "/gifs/dance.gif"); err != nil || info.IsDir() {
+		t.Errorf("stat of an object: got %v, %v", info, err)
+	}
+}
+
+// failingReader returns err once the data is read.
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestDavPut(t *testing.T) {
+	p := newFakeCloud("/", map[string]string{"dance.gif": "original"})
+	m := &mount{name: "gifs", p: p}
+	mountsMu.Lock()
+	mounts = []*mount{m}
+	mountsMu.Unlock()
+	configMu.Lock()
+	webdavWritable = true
+	configMu.Unlock()
+	defer func() {
+		mountsMu.Lock()
+		mounts = nil
+		mountsMu.Unlock()
+		configMu.Lock()
+		webdavWritable = false
+		configMu.Unlock()
+	}()
+
+	h := davHandler("/dav")
+	put := func(body io.Reader) {
+		r := httptest.NewRequest("PUT", "/dav/gifs/dance.gif", body)
+		r = r.WithContext(withIdentity(r.Context(), &identity{User: "alice"}))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	content := func() string {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return string(p.objects["dance.gif"])
+	}
+
+	// a body that fails halfway leaves the object as it was
+	put(&failingReader{strings.NewReader("trunc"), errors.New("connection reset")})
+	if got := content(); got != "original" {
+		t.Errorf("after an interrupted PUT: got %q, want %q", got, "original")
+	}
+
+	put(strings.NewReader("replaced"))
+	if got := content(); got != "replaced" {
+		t.Errorf("after a PUT: got %q, want %q", got, "replaced")
+	}
+}